@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/luke-cha/ios-screen-mirror/mirror"
+)
+
+// configFile is the JSON file given with -config. The defaults replace the default values of the flags,
+// the settings of a device replace the defaults for that udid. Flags that are given override both.
+//
+//	{
+//	  "defaults": {"pushSpec": "ipc:///tmp/mirror-{udid}.ipc", "screenRatio": 0.5},
+//	  "devices": {"<udid>": {"pushSpec": "tcp://127.0.0.1:7880", "imageFormat": "png", "recordingDir": "/srv/recordings"}}
+//	}
+type configFile struct {
+	Defaults deviceSettings            `json:"defaults"`
+	Devices  map[string]deviceSettings `json:"devices"`
+}
+
+// deviceSettings are the settings of the config file, settings that are not given keep their previous value.
+type deviceSettings struct {
+	PushSpec    *string  `json:"pushSpec"`
+	ScreenRatio *float64 `json:"screenRatio"`
+	ImageFormat *string  `json:"imageFormat"`
+	// RecordingDir records the video of every device as <udid>.mp4 into the directory.
+	RecordingDir    *string `json:"recordingDir"`
+	ChangeThreshold *int64  `json:"changeThreshold"`
+}
+
+// loadConfigFile reads and validates the config file, unknown fields are rejected to catch typos.
+func loadConfigFile(filename string) (configFile, error) {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return configFile{}, err
+	}
+	defer fh.Close()
+
+	var config configFile
+	decoder := json.NewDecoder(fh)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return configFile{}, fmt.Errorf("config %s: %s", filename, err)
+	}
+	if err := config.Defaults.validate(); err != nil {
+		return configFile{}, fmt.Errorf("config %s: defaults: %s", filename, err)
+	}
+	for udid, settings := range config.Devices {
+		if strings.TrimSpace(udid) == "" {
+			return configFile{}, fmt.Errorf("config %s: devices need a udid", filename)
+		}
+		if err := settings.validate(); err != nil {
+			return configFile{}, fmt.Errorf("config %s: device %s: %s", filename, udid, err)
+		}
+	}
+	return config, nil
+}
+
+func (s deviceSettings) validate() error {
+	if s.PushSpec != nil && *s.PushSpec != "" && !strings.Contains(*s.PushSpec, "://") {
+		return fmt.Errorf("pushSpec '%s' is not an address like tcp://127.0.0.1:7879", *s.PushSpec)
+	}
+	if s.ScreenRatio != nil && *s.ScreenRatio <= 0 {
+		return fmt.Errorf("screenRatio %v has to be greater than 0", *s.ScreenRatio)
+	}
+	if s.ImageFormat != nil {
+		if _, err := mirror.ParseImageFormat(*s.ImageFormat); err != nil {
+			return err
+		}
+	}
+	if s.RecordingDir != nil {
+		if *s.RecordingDir == "" {
+			return errors.New("recordingDir can not be empty")
+		}
+		if info, err := os.Stat(*s.RecordingDir); err == nil && !info.IsDir() {
+			return fmt.Errorf("recordingDir '%s' is not a directory", *s.RecordingDir)
+		}
+	}
+	return nil
+}
+
+// withoutFlags drops the settings that were given as flags, as flags override the config file.
+func (s deviceSettings) withoutFlags(explicit map[string]bool) deviceSettings {
+	if explicit["pushSpec"] {
+		s.PushSpec = nil
+	}
+	if explicit["screenRatio"] {
+		s.ScreenRatio = nil
+	}
+	if explicit["imageFormat"] {
+		s.ImageFormat = nil
+	}
+	if explicit["mp4"] {
+		s.RecordingDir = nil
+	}
+	if explicit["changeThreshold"] {
+		s.ChangeThreshold = nil
+	}
+	return s
+}
+
+// applyDefaults sets the flags that were not given to the defaults of the config file.
+func (c configFile) applyDefaults(explicit map[string]bool) error {
+	defaults := c.Defaults.withoutFlags(explicit)
+	values := map[string]string{}
+	if defaults.PushSpec != nil {
+		values["pushSpec"] = *defaults.PushSpec
+	}
+	if defaults.ScreenRatio != nil {
+		values["screenRatio"] = strconv.FormatFloat(*defaults.ScreenRatio, 'g', -1, 64)
+	}
+	if defaults.ImageFormat != nil {
+		values["imageFormat"] = *defaults.ImageFormat
+	}
+	if defaults.RecordingDir != nil {
+		values["mp4"] = recordingFile(*defaults.RecordingDir)
+	}
+	if defaults.ChangeThreshold != nil {
+		values["changeThreshold"] = strconv.FormatInt(*defaults.ChangeThreshold, 10)
+	}
+	for name, value := range values {
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("config default %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// deviceSettings returns the settings of every configured device without the ones given as flags.
+func (c configFile) deviceSettings(explicit map[string]bool) map[string]deviceSettings {
+	settings := make(map[string]deviceSettings, len(c.Devices))
+	for udid, device := range c.Devices {
+		settings[udid] = device.withoutFlags(explicit)
+	}
+	return settings
+}
+
+// createRecordingDirs creates all recording directories of the config file.
+func (c configFile) createRecordingDirs() error {
+	settings := []deviceSettings{c.Defaults}
+	for _, device := range c.Devices {
+		settings = append(settings, device)
+	}
+	for _, s := range settings {
+		if s.RecordingDir == nil {
+			continue
+		}
+		if err := os.MkdirAll(*s.RecordingDir, 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordingFile is the mp4 file of a device in the recording directory, the udid placeholder keeps it usable as
+// file name pattern of several devices.
+func recordingFile(dir string) string {
+	return filepath.Join(dir, udidPlaceholder+".mp4")
+}
+
+// hasRecordingDir reports whether the defaults or a device record into a directory.
+func (c configFile) hasRecordingDir() bool {
+	if c.Defaults.RecordingDir != nil {
+		return true
+	}
+	for _, device := range c.Devices {
+		if device.RecordingDir != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// apply overrides the options and outputs of the device with the settings.
+func (s deviceSettings) apply(options *pullOptions, target *pullTarget) {
+	s.applyOutputs(target)
+	if s.ScreenRatio != nil {
+		options.screenRatio = *s.ScreenRatio
+	}
+	if s.ImageFormat != nil {
+		options.push.Encoder.Format = mirror.ImageFormat(*s.ImageFormat)
+	}
+	if s.ChangeThreshold != nil {
+		options.changeThreshold = *s.ChangeThreshold
+	}
+}
+
+// applyOutputs overrides the push spec and the mp4 file of the device, which has to have a udid.
+func (s deviceSettings) applyOutputs(target *pullTarget) {
+	if s.PushSpec != nil {
+		target.pushSpec = strings.ReplaceAll(*s.PushSpec, udidPlaceholder, target.udid)
+	}
+	if s.RecordingDir != nil {
+		target.mp4File = strings.ReplaceAll(recordingFile(*s.RecordingDir), udidPlaceholder, target.udid)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/luke-cha/ios-screen-mirror/mirror"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	notADir := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(notADir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		config string
+		// err is part of the expected error, empty if the config is valid
+		err string
+	}{
+		{name: "empty", config: `{}`},
+		{name: "valid", config: `{"defaults": {"pushSpec": "ipc:///tmp/mirror-{udid}.ipc", "screenRatio": 0.5},
+			"devices": {"00008030": {"imageFormat": "png", "recordingDir": "` + dir + `", "changeThreshold": 3}}}`},
+		{name: "unknown field", config: `{"default": {}}`, err: `unknown field "default"`},
+		{name: "unknown device field", config: `{"devices": {"00008030": {"pushSpecs": "tcp://:7879"}}}`, err: `unknown field "pushSpecs"`},
+		{name: "wrong type", config: `{"defaults": {"screenRatio": "half"}}`, err: "screenRatio"},
+		{name: "push spec without scheme", config: `{"defaults": {"pushSpec": "127.0.0.1:7879"}}`, err: "defaults: pushSpec '127.0.0.1:7879' is not an address"},
+		{name: "screen ratio", config: `{"devices": {"00008030": {"screenRatio": 0}}}`, err: "device 00008030: screenRatio 0 has to be greater than 0"},
+		{name: "image format", config: `{"defaults": {"imageFormat": "gif"}}`, err: "unknown image format 'gif'"},
+		{name: "empty recording dir", config: `{"defaults": {"recordingDir": ""}}`, err: "recordingDir can not be empty"},
+		{name: "recording dir is a file", config: `{"defaults": {"recordingDir": "` + notADir + `"}}`, err: "is not a directory"},
+		{name: "empty udid", config: `{"devices": {" ": {}}}`, err: "devices need a udid"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filename := filepath.Join(dir, "config.json")
+			if err := ioutil.WriteFile(filename, []byte(test.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := loadConfigFile(filename)
+			if test.err == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestDeviceSettingsApply(t *testing.T) {
+	pushSpec := "ipc:///tmp/mirror-{udid}.ipc"
+	recordingDir := "/srv/recordings"
+	ratio := 0.25
+	format := "png"
+	threshold := int64(7)
+
+	tests := []struct {
+		name        string
+		settings    deviceSettings
+		wantTarget  pullTarget
+		wantOptions pullOptions
+	}{
+		{
+			name:        "nothing",
+			wantTarget:  pullTarget{udid: "00008030", pushSpec: "tcp://127.0.0.1:7879"},
+			wantOptions: pullOptions{screenRatio: 1},
+		},
+		{
+			name:     "udid placeholders",
+			settings: deviceSettings{PushSpec: &pushSpec, RecordingDir: &recordingDir},
+			wantTarget: pullTarget{
+				udid:     "00008030",
+				pushSpec: "ipc:///tmp/mirror-00008030.ipc",
+				mp4File:  filepath.Join(recordingDir, "00008030.mp4"),
+			},
+			wantOptions: pullOptions{screenRatio: 1},
+		},
+		{
+			name:        "options",
+			settings:    deviceSettings{ScreenRatio: &ratio, ImageFormat: &format, ChangeThreshold: &threshold},
+			wantTarget:  pullTarget{udid: "00008030", pushSpec: "tcp://127.0.0.1:7879"},
+			wantOptions: pullOptions{screenRatio: 0.25, changeThreshold: 7, push: mirror.PushConfig{Encoder: mirror.ImageEncoder{Format: mirror.ImageFormatPng}}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target := pullTarget{udid: "00008030", pushSpec: "tcp://127.0.0.1:7879"}
+			options := pullOptions{screenRatio: 1}
+			test.settings.apply(&options, &target)
+			if target != test.wantTarget {
+				t.Errorf("got target %+v, want %+v", target, test.wantTarget)
+			}
+			if !reflect.DeepEqual(options, test.wantOptions) {
+				t.Errorf("got options %+v, want %+v", options, test.wantOptions)
+			}
+		})
+	}
+}
+
+func TestDeviceSettingsWithoutFlags(t *testing.T) {
+	pushSpec := "tcp://127.0.0.1:7880"
+	ratio := 0.5
+	recordingDir := "/srv/recordings"
+	settings := deviceSettings{PushSpec: &pushSpec, ScreenRatio: &ratio, RecordingDir: &recordingDir}
+
+	tests := []struct {
+		name     string
+		explicit map[string]bool
+		want     deviceSettings
+	}{
+		{name: "no flags", want: settings},
+		{name: "push spec", explicit: map[string]bool{"pushSpec": true}, want: deviceSettings{ScreenRatio: &ratio, RecordingDir: &recordingDir}},
+		{name: "mp4 replaces the recording dir", explicit: map[string]bool{"mp4": true, "screenRatio": true}, want: deviceSettings{PushSpec: &pushSpec}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := settings.withoutFlags(test.explicit); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/luke-cha/ios-screen-mirror/mirror"
+	log "github.com/sirupsen/logrus"
+)
+
+// sessionRequest is the body of POST /sessions and PUT /sessions/<udid>, it holds the outputs of one device
+// like the flags of -pull do. Empty outputs fall back to the settings of the device or the defaults in the config
+// file or are disabled, a missing screenRatio keeps the one of the config file or the -screenRatio flag.
+// File outputs are relative to the root directory of the daemon and can not leave it.
+type sessionRequest struct {
+	Udid        string  `json:"udid"`
+	PushSpec    string  `json:"pushSpec,omitempty"`
+	File        string  `json:"file,omitempty"`
+	AudioFile   string  `json:"audioFile,omitempty"`
+	CaptureUsb  string  `json:"captureUsb,omitempty"`
+	Mp4         string  `json:"mp4,omitempty"`
+	Hls         string  `json:"hls,omitempty"`
+	ScreenRatio float64 `json:"screenRatio,omitempty"`
+}
+
+type sessionResponse struct {
+	Config sessionRequest       `json:"config"`
+	Status mirror.SessionStatus `json:"status"`
+}
+
+// daemon starts, changes and stops the sessions of devices on behalf of REST requests:
+//
+//	GET    /sessions         lists all sessions
+//	POST   /sessions         starts a session for the udid of the sessionRequest
+//	GET    /sessions/<udid>  returns one session
+//	PUT    /sessions/<udid>  restarts the session with the outputs of the sessionRequest
+//	DELETE /sessions/<udid>  stops the session
+//
+// Sessions are activated in the background, their state shows whether the device is streaming already.
+// The api has no authentication, it should only be reachable by trusted clients.
+type daemon struct {
+	ctx     context.Context
+	options pullOptions
+	// defaults are the settings of the config file for all devices, their outputs apply to every session
+	defaults deviceSettings
+	// root is the directory the file outputs of requests are created in, empty rejects file outputs
+	root string
+
+	mu       sync.Mutex
+	sessions map[string]*daemonSession
+	// pending holds the udids whose session is being created, so that concurrent requests do not both
+	// create its outputs
+	pending map[string]bool
+}
+
+type daemonSession struct {
+	request sessionRequest
+	// target holds the outputs of the request resolved into file names
+	target  pullTarget
+	session *mirror.Session
+	cancel  context.CancelFunc
+	// done is closed once the session ended and its outputs were closed
+	done chan struct{}
+}
+
+func newDaemon(ctx context.Context, options pullOptions, defaults deviceSettings, root string) *daemon {
+	return &daemon{
+		ctx:      ctx,
+		options:  options,
+		defaults: defaults,
+		root:     root,
+		sessions: map[string]*daemonSession{},
+		pending:  map[string]bool{},
+	}
+}
+
+func (d *daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	udid := strings.Trim(strings.TrimPrefix(r.URL.Path, "/sessions"), "/")
+	switch {
+	case udid == "" && r.Method == http.MethodGet:
+		d.list(w)
+	case udid == "" && r.Method == http.MethodPost:
+		request, ok := readSessionRequest(w, r, "")
+		if !ok {
+			return
+		}
+		d.respond(w, http.StatusCreated, request.Udid, func() error { return d.start(request, false) })
+	case udid != "" && r.Method == http.MethodGet:
+		d.respond(w, http.StatusOK, udid, nil)
+	case udid != "" && r.Method == http.MethodPut:
+		request, ok := readSessionRequest(w, r, udid)
+		if !ok {
+			return
+		}
+		d.respond(w, http.StatusOK, udid, func() error { return d.start(request, true) })
+	case udid != "" && r.Method == http.MethodDelete:
+		d.respond(w, http.StatusOK, udid, func() error { return d.stop(udid) })
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+var (
+	errSessionRunning = errors.New("a session for this udid is running already")
+	errUnknownSession = errors.New("no session for this udid")
+)
+
+// udidPattern keeps udids from naming other directories, they are part of file names.
+var udidPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// respond runs the action and answers with the session afterwards, or with the error of the action.
+func (d *daemon) respond(w http.ResponseWriter, status int, udid string, action func() error) {
+	if action != nil {
+		if err := action(); err != nil {
+			code := http.StatusBadRequest
+			switch err {
+			case errSessionRunning:
+				code = http.StatusConflict
+			case errUnknownSession:
+				code = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+	}
+	d.mu.Lock()
+	running, ok := d.sessions[udid]
+	d.mu.Unlock()
+	if !ok {
+		http.Error(w, errUnknownSession.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(sessionResponse{Config: running.request, Status: running.session.Status()})
+}
+
+func (d *daemon) list(w http.ResponseWriter) {
+	d.mu.Lock()
+	responses := make([]sessionResponse, 0, len(d.sessions))
+	for _, running := range d.sessions {
+		responses = append(responses, sessionResponse{Config: running.request, Status: running.session.Status()})
+	}
+	d.mu.Unlock()
+	sort.Slice(responses, func(i, j int) bool { return responses[i].Config.Udid < responses[j].Config.Udid })
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"sessions": responses})
+}
+
+func readSessionRequest(w http.ResponseWriter, r *http.Request, udid string) (sessionRequest, bool) {
+	var request sessionRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		http.Error(w, "invalid session request: "+err.Error(), http.StatusBadRequest)
+		return request, false
+	}
+	if udid != "" {
+		request.Udid = udid
+	}
+	if request.Udid == "" {
+		http.Error(w, "the session request needs a udid", http.StatusBadRequest)
+		return request, false
+	}
+	if !udidPattern.MatchString(request.Udid) {
+		http.Error(w, "the udid can only contain letters, digits, '-' and '_'", http.StatusBadRequest)
+		return request, false
+	}
+	if request.ScreenRatio < 0 {
+		http.Error(w, "the screen ratio can not be negative", http.StatusBadRequest)
+		return request, false
+	}
+	return request, true
+}
+
+// start creates the session of the request and activates it in the background. replace stops a running
+// session of the udid once the new session was created, otherwise it is an error.
+func (d *daemon) start(request sessionRequest, replace bool) error {
+	d.mu.Lock()
+	running, ok := d.sessions[request.Udid]
+	if d.pending[request.Udid] || (ok && !replace && !running.ended()) {
+		d.mu.Unlock()
+		return errSessionRunning
+	}
+	d.pending[request.Udid] = true
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.pending, request.Udid)
+		d.mu.Unlock()
+	}()
+
+	target, options, err := d.resolve(request)
+	if err != nil {
+		return err
+	}
+	if ok && running.target.sharesFiles(target) {
+		// creating the files again would truncate them under the running session
+		running.stop()
+	}
+	session, closeOutputs, err := deviceSession(target, options)
+	if err != nil {
+		return err
+	}
+	if ok {
+		running.stop()
+	}
+
+	ctx, cancel := context.WithCancel(d.ctx)
+	started := &daemonSession{request: request, target: target, session: session, cancel: cancel, done: make(chan struct{})}
+	d.mu.Lock()
+	d.sessions[request.Udid] = started
+	d.mu.Unlock()
+
+	go func() {
+		defer close(started.done)
+		defer closeOutputs()
+		if err := startSession(ctx, session); err != nil {
+			printErrJSON(err, "Error starting session of '"+request.Udid+"'")
+			return
+		}
+		go func() {
+			for err := range session.Errors() {
+				log.Errorf("Session failure - %s", err)
+			}
+		}()
+		<-session.Done()
+		log.WithFields(log.Fields{
+			"type": "session_stopped",
+			"udid": request.Udid,
+		}).Info("Session stopped")
+	}()
+	return nil
+}
+
+// resolve returns the outputs and options of the request, with the settings of the config file for the
+// outputs it leaves out.
+func (d *daemon) resolve(request sessionRequest) (pullTarget, pullOptions, error) {
+	target := pullTarget{udid: request.Udid}
+	d.defaults.applyOutputs(&target)
+	options, target := d.options.forDevice(target)
+	if request.ScreenRatio > 0 {
+		options.screenRatio = request.ScreenRatio
+	}
+	if request.PushSpec != "" {
+		target.pushSpec = request.PushSpec
+	}
+	for _, output := range []struct {
+		name   string
+		value  string
+		target *string
+	}{
+		{"file", request.File, &target.file},
+		{"audioFile", request.AudioFile, &target.audioFile},
+		{"captureUsb", request.CaptureUsb, &target.captureUsb},
+		{"mp4", request.Mp4, &target.mp4File},
+		{"hls", request.Hls, &target.hlsDir},
+	} {
+		if output.value == "" {
+			continue
+		}
+		path, err := d.outputPath(output.name, output.value)
+		if err != nil {
+			return pullTarget{}, pullOptions{}, err
+		}
+		*output.target = path
+	}
+	return target, options, nil
+}
+
+// outputPath returns the file name of an output of a request inside the root directory.
+func (d *daemon) outputPath(name string, value string) (string, error) {
+	if d.root == "" {
+		return "", fmt.Errorf("%s needs the daemon to be started with -daemonRoot", name)
+	}
+	if filepath.IsAbs(value) {
+		return "", fmt.Errorf("%s has to be relative to the daemon root", name)
+	}
+	path := filepath.Join(d.root, value)
+	if rel, err := filepath.Rel(d.root, path); err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s has to name a file inside the daemon root", name)
+	}
+	return path, nil
+}
+
+// stop ends the session of the udid and waits until its outputs are closed, the stopped session stays listed.
+func (d *daemon) stop(udid string) error {
+	d.mu.Lock()
+	running, ok := d.sessions[udid]
+	d.mu.Unlock()
+	if !ok {
+		return errUnknownSession
+	}
+	running.stop()
+	return nil
+}
+
+// wait blocks until all sessions ended, they stop on their own once the context of the daemon is done.
+func (d *daemon) wait() {
+	d.mu.Lock()
+	sessions := make([]*daemonSession, 0, len(d.sessions))
+	for _, running := range d.sessions {
+		sessions = append(sessions, running)
+	}
+	d.mu.Unlock()
+	for _, running := range sessions {
+		<-running.done
+	}
+}
+
+// stop ends the session and waits until its outputs are closed.
+func (s *daemonSession) stop() {
+	s.cancel()
+	<-s.done
+}
+
+func (s *daemonSession) ended() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// loopbackAddr binds an address without host to localhost only, as the daemon api has no authentication.
+func loopbackAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != "" {
+		return addr
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+// daemonRootDir returns the absolute root directory for the file outputs of requests, empty if none is given.
+func daemonRootDir(dir string) (string, error) {
+	if dir == "" {
+		return "", nil
+	}
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	if info, err := os.Stat(root); err != nil {
+		return "", err
+	} else if !info.IsDir() {
+		return "", fmt.Errorf("daemon root '%s' is not a directory", dir)
+	}
+	return root, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestDaemonOutputPath(t *testing.T) {
+	root := filepath.FromSlash("/srv/mirror")
+	tests := []struct {
+		name  string
+		root  string
+		value string
+		want  string
+		err   bool
+	}{
+		{name: "file in the root", root: root, value: "record.mp4", want: filepath.Join(root, "record.mp4")},
+		{name: "sub directory", root: root, value: "hls/device", want: filepath.Join(root, "hls", "device")},
+		{name: "parent inside the root", root: root, value: "hls/../record.mp4", want: filepath.Join(root, "record.mp4")},
+		{name: "no root", value: "record.mp4", err: true},
+		{name: "absolute path", root: root, value: "/etc/passwd", err: true},
+		{name: "parent directory", root: root, value: "../record.mp4", err: true},
+		{name: "hidden parent directory", root: root, value: "hls/../../record.mp4", err: true},
+		{name: "the root itself", root: root, value: ".", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := newDaemon(context.Background(), pullOptions{}, deviceSettings{}, test.root)
+			path, err := d.outputPath("mp4", test.value)
+			if test.err {
+				if err == nil {
+					t.Errorf("got %s, want an error", path)
+				}
+				return
+			}
+			if err != nil || path != test.want {
+				t.Errorf("got %s, %v, want %s", path, err, test.want)
+			}
+		})
+	}
+}
+
+func TestPullTargetSharesFiles(t *testing.T) {
+	running := pullTarget{udid: "00008030", pushSpec: "tcp://127.0.0.1:7879", mp4File: "/srv/mirror/record.mp4"}
+	tests := []struct {
+		name   string
+		target pullTarget
+		want   bool
+	}{
+		{name: "same push spec", target: pullTarget{pushSpec: "tcp://127.0.0.1:7879"}, want: false},
+		{name: "other file", target: pullTarget{mp4File: "/srv/mirror/other.mp4"}, want: false},
+		{name: "same file", target: pullTarget{mp4File: "/srv/mirror/./record.mp4"}, want: true},
+		{name: "same file as other output", target: pullTarget{file: "/srv/mirror/record.mp4"}, want: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := running.sharesFiles(test.target); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
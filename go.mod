@@ -6,6 +6,7 @@ require (
 	github.com/3d0c/gmf v0.0.0-20220906170454-be727bc5b56c
 	github.com/danielpaulus/quicktime_video_hack v0.0.0-20230504104950-d81396e2e775
 	github.com/google/gousb v2.1.0+incompatible
+	github.com/gorilla/websocket v1.5.0
 	github.com/nanomsg/mangos v2.0.0+incompatible
 	github.com/sirupsen/logrus v1.7.0
 	go.nanomsg.org/mangos/v3 v3.4.2
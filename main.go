@@ -2,19 +2,21 @@ package main
 
 import (
 	"bufio"
-	"encoding/binary"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
-	"image"
-	"io"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/danielpaulus/quicktime_video_hack/screencapture"
-	"go.nanomsg.org/mangos/v3"
-	"go.nanomsg.org/mangos/v3/protocol/push"
+	"github.com/luke-cha/ios-screen-mirror/mirror"
 
 	// register transports
 	_ "github.com/nanomsg/mangos/transport/all"
@@ -22,38 +24,236 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-var (
-	pr                   *io.PipeReader
-	pw                   *io.PipeWriter
-	pushSock             mangos.Socket
-	prevImg              *image.RGBA
-	fileMode             bool
-	screenReductionRatio float64
-)
-
 func main() {
-	var udid = flag.String("udid", "", "Device UDID")
+	var udid = flag.String("udid", "", "Device UDID, comma separated to pull several devices")
 	var devicesCmd = flag.Bool("devices", false, "List devices then exit")
+	var screenshotFile = flag.String("screenshot", "", "Write one screenshot of the device into this file then exit, the format follows -imageFormat or the extension")
+	var screenshotTimeout = flag.Duration("screenshotTimeout", 10*time.Second, "Time to wait for the screenshot before giving up")
 	var pullCmd = flag.Bool("pull", false, "Pull video")
-	var pushSpec = flag.String("pushSpec", "tcp://127.0.0.1:7879", "push image to tcp address")
-	var file = flag.String("file", "", "File to save h264 nalus into")
+	var allDevices = flag.Bool("all", false, "Pull video of all connected devices")
+	var watchCmd = flag.Bool("watch", false, "Keep running and pull every device that gets attached, push spec has to contain {udid}")
+	var daemonAddr = flag.String("daemon", "", "Keep running and start, change and stop sessions through a REST api on /sessions of this address, a port without host only listens on localhost")
+	var daemonRoot = flag.String("daemonRoot", "", "Directory the file outputs of -daemon requests are created in, they are rejected without it")
+	var format = flag.String("format", "jpeg", "Format pushed to the push spec, jpeg frames or h264 access units in annex b format without decoding")
+	var imageFormat = flag.String("imageFormat", "jpeg", "Encoding of the pushed frames: jpeg, png, rgba (raw pixels) or yuv (raw I420 planes)")
+	var jpegQuality = flag.Int("jpegQuality", 75, "Quality of jpeg frames from 1 to 100, also used by the http viewers")
+	var changeThreshold = flag.Int64("changeThreshold", mirror.DefaultChangeThreshold, "Difference score a frame needs against the previous one to be sent, 0 sends every change, without delta frames")
+	var tileSize = flag.Int("tileSize", 0, "Push delta frames with the changed tiles of this size in pixels instead of whole frames, 0 disables them")
+	var tileThreshold = flag.Int64("tileThreshold", 0, "Difference score a tile needs to be sent in a delta frame, 0 sends every change")
+	var keyframeInterval = flag.Duration("keyframeInterval", 10*time.Second, "Time after which delta frames send the whole frame again")
+	var keepAlive = flag.Duration("keepAlive", 0, "Resend the last frame when the screen did not change for this long, 0 disables it")
+	var sendLatest = flag.Bool("sendLatest", true, "Send the current frame to http viewers right when they connect")
+	var legacyRaw = flag.Bool("legacyRaw", false, "Push the bare image or h264 without the metadata envelope, for old consumers")
+	var pushSpec = flag.String("pushSpec", "tcp://127.0.0.1:7879", "push image to tcp address, comma separated or containing {udid} for several devices, empty to disable")
+	var file = flag.String("file", "", "File to save h264 nalus into, has to contain {udid} for several devices")
 	var reductionRatio = flag.Float64("screenRatio", 0.5, "Screen reduction ratio")
+	var maxWidth = flag.Int("maxWidth", 0, "Shrink frames further until they are at most this wide, keeping the aspect ratio, 0 disables it")
+	var maxHeight = flag.Int("maxHeight", 0, "Shrink frames further until they are at most this high, keeping the aspect ratio, 0 disables it")
+	var width = flag.Int("width", 0, "Fixed frame width replacing -screenRatio, the aspect ratio is kept if -height is not given")
+	var height = flag.Int("height", 0, "Fixed frame height replacing -screenRatio, the aspect ratio is kept if -width is not given")
+	var crop = flag.String("crop", "", "Part of the screen to keep as x,y,width,height in device pixels, for example 0,88,1170,2444 to remove the status bar")
+	var scaleAlgorithm = flag.String("scaleAlgorithm", "bicubic", "Scaling algorithm: fast_bilinear, bilinear, bicubic, point, area, lanczos or spline")
+	var replayFile = flag.String("replay", "", "Replay a h264 file written with -file through the jpeg pipeline instead of pulling a device")
+	var replayFps = flag.Float64("replayFps", 30, "Pictures per second to replay with, 0 replays as fast as possible")
+	var audioFile = flag.String("audioFile", "", "File to save the device audio into as wav, has to contain {udid} for several devices")
+	var mp4File = flag.String("mp4", "", "File to record the video into as fragmented mp4, has to contain {udid} for several devices")
+	var captureUsb = flag.String("captureUsb", "", "File to record all usb messages into, has to contain {udid} for several devices")
+	var replayUsb = flag.String("replayUsb", "", "Replay a usb capture written with -captureUsb instead of pulling a device")
+	var replayUsbRealtime = flag.Bool("replayUsbRealtime", true, "Keep the recorded time between usb messages when replaying a usb capture")
+	var httpAddr = flag.String("http", "", "Serve a MJPEG viewer on / and a websocket viewer on /ws/ of this address, for example :8000")
+	var hlsDir = flag.String("hls", "", "Directory to write a HLS playlist with fragmented mp4 segments into, has to contain {udid} for several devices")
+	var hlsSegment = flag.Duration("hlsSegment", 2*time.Second, "Minimum HLS segment duration, segments are cut at key frames and at twice this duration at the latest")
+	var hlsPart = flag.Duration("hlsPart", 0, "Duration of low latency HLS partial segments, 0 disables them")
+	var rtspAddr = flag.String("rtsp", "", "Serve the h264 stream of every device on rtsp://<address>/<udid>, for example :8554")
+	var metricsAddr = flag.String("metrics", "", "Serve prometheus metrics of every device on /metrics of this address, can be the -http address")
+	var statusAddr = flag.String("status", "", "Serve the devices and sessions as JSON on /status of this address, can be the -http address")
+	var configPath = flag.String("config", "", "JSON file with defaults and per udid settings, flags that are given override it")
 	var verbose = flag.Bool("v", false, "Verbose Debugging")
 	flag.Parse()
 
 	log.SetFormatter(&log.JSONFormatter{})
-	screenReductionRatio = *reductionRatio
 
 	if *verbose {
 		log.Info("Set Debug mode")
 		log.SetLevel(log.DebugLevel)
 	}
 
+	// flags given on the command line, before the config file set any
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	var deviceConfigs map[string]deviceSettings
+	var configDefaults deviceSettings
+	if *configPath != "" {
+		config, err := loadConfigFile(*configPath)
+		if err == nil && *watchCmd && config.hasRecordingDir() {
+			err = fmt.Errorf("config %s: recordingDir is not supported with -watch", *configPath)
+		}
+		if err == nil {
+			err = config.applyDefaults(explicit)
+		}
+		if err == nil {
+			err = config.createRecordingDirs()
+		}
+		if err != nil {
+			printErrJSON(err, "Invalid config")
+			os.Exit(1)
+		}
+		deviceConfigs = config.deviceSettings(explicit)
+		configDefaults = config.Defaults
+	}
+
+	if *format != formatJpeg && *format != formatH264 {
+		printErrJSON(fmt.Errorf("unknown format %s", *format), "Invalid arguments")
+		os.Exit(1)
+	}
+	pushFormat, err := mirror.ParseImageFormat(*imageFormat)
+	if err != nil {
+		printErrJSON(err, "Invalid arguments")
+		os.Exit(1)
+	}
+	if *jpegQuality < 1 || *jpegQuality > 100 {
+		printErrJSON(fmt.Errorf("jpeg quality %d is not between 1 and 100", *jpegQuality), "Invalid arguments")
+		os.Exit(1)
+	}
+	if *maxWidth < 0 || *maxHeight < 0 || *width < 0 || *height < 0 {
+		printErrJSON(errors.New("frame sizes can not be negative"), "Invalid arguments")
+		os.Exit(1)
+	}
+	cropRect, err := mirror.ParseCrop(*crop)
+	if err != nil {
+		printErrJSON(err, "Invalid arguments")
+		os.Exit(1)
+	}
+	algorithm, err := mirror.ParseScaleAlgorithm(*scaleAlgorithm)
+	if err != nil {
+		printErrJSON(err, "Invalid arguments")
+		os.Exit(1)
+	}
+	options := pullOptions{
+		format: *format,
+		push: mirror.PushConfig{
+			Encoder: mirror.ImageEncoder{Format: pushFormat, JpegQuality: *jpegQuality},
+			Raw:     *legacyRaw,
+		},
+		viewerEncoder:   mirror.ImageEncoder{Format: mirror.ImageFormatJpeg, JpegQuality: *jpegQuality},
+		screenRatio:     *reductionRatio,
+		changeThreshold: *changeThreshold,
+		keepAlive:       *keepAlive,
+		hls:             mirror.HlsConfig{SegmentDuration: *hlsSegment, PartDuration: *hlsPart},
+		devices:         deviceConfigs,
+		scale: mirror.ScaleConfig{
+			Width:     *width,
+			Height:    *height,
+			MaxWidth:  *maxWidth,
+			MaxHeight: *maxHeight,
+			Crop:      cropRect,
+			Algorithm: algorithm,
+		},
+	}
+	if *tileSize > 0 {
+		options.push.Tiles = &mirror.TileConfig{TileSize: *tileSize, Threshold: *tileThreshold, KeyframeInterval: *keyframeInterval}
+	}
+	outputs := pullTarget{
+		pushSpec:   *pushSpec,
+		file:       *file,
+		audioFile:  *audioFile,
+		captureUsb: *captureUsb,
+		mp4File:    *mp4File,
+		hlsDir:     *hlsDir,
+	}
+	streaming := *watchCmd || *pullCmd || *daemonAddr != "" || *replayFile != "" || *replayUsb != ""
+	// the http endpoints can share addresses
+	muxes := map[string]*http.ServeMux{}
+	handle := func(addr string, pattern string, handler http.Handler) {
+		mux, ok := muxes[addr]
+		if !ok {
+			mux = http.NewServeMux()
+			muxes[addr] = mux
+		}
+		mux.Handle(pattern, handler)
+	}
+	if *metricsAddr != "" && streaming {
+		options.metrics = mirror.NewMetrics()
+		options.push.Metrics = options.metrics
+		handle(*metricsAddr, "/metrics", options.metrics)
+	}
+	if *statusAddr != "" && streaming {
+		options.status = mirror.NewStatusServer()
+		handle(*statusAddr, "/status/", http.StripPrefix("/status", options.status))
+	}
+	if *httpAddr != "" && streaming {
+		streamConfig := mirror.StreamConfig{SendLatestOnConnect: *sendLatest}
+		options.mjpeg = mirror.NewMjpegServer(streamConfig)
+		options.webSocket = mirror.NewWebSocketServer(streamConfig)
+		handle(*httpAddr, "/", options.mjpeg)
+		handle(*httpAddr, "/ws/", http.StripPrefix("/ws", options.webSocket))
+	}
+	if *rtspAddr != "" && streaming {
+		options.rtsp = mirror.NewRtspServer()
+		serveRtsp(*rtspAddr, options.rtsp)
+	}
+	// the daemon copies the options, so they have to be complete by now
+	var api *daemon
+	if *daemonAddr != "" {
+		root, err := daemonRootDir(*daemonRoot)
+		if err != nil {
+			printErrJSON(err, "Invalid arguments")
+			os.Exit(1)
+		}
+		ctx, stop := shutdownContext()
+		defer stop()
+		api = newDaemon(ctx, options, configDefaults, root)
+		// the api has no authentication, other hosts only reach it if asked for
+		addr := loopbackAddr(*daemonAddr)
+		handle(addr, "/sessions", api)
+		handle(addr, "/sessions/", api)
+	}
+	for addr, mux := range muxes {
+		serveHTTP(addr, mux)
+	}
+
 	if *devicesCmd {
 		devices()
 		return
+	} else if *screenshotFile != "" {
+		if len(splitList(*udid)) > 1 {
+			printErrJSON(errors.New("a screenshot is taken of a single device"), "Invalid arguments")
+			os.Exit(1)
+		}
+		screenshotEncoder := mirror.ImageEncoder{JpegQuality: *jpegQuality}
+		if screenshotEncoder.Format, err = screenshotFormat(*screenshotFile, *imageFormat, explicit["imageFormat"]); err != nil {
+			printErrJSON(err, "Invalid arguments")
+			os.Exit(1)
+		}
+		if !explicit["screenRatio"] && !explicit["width"] && !explicit["height"] && !explicit["maxWidth"] && !explicit["maxHeight"] {
+			// screenshots keep the full resolution unless a size was asked for
+			options.screenRatio = 1
+		}
+		os.Exit(screenshot(*udid, *screenshotFile, screenshotEncoder, options, *screenshotTimeout))
+	} else if *replayFile != "" || *replayUsb != "" {
+		source := replaySource{file: *replayFile, fps: *replayFps}
+		if *replayUsb != "" {
+			source = replaySource{file: *replayUsb, usb: true, realtime: *replayUsbRealtime}
+		}
+		if err := replay(source, outputs, options); err != nil {
+			printErrJSON(err, "Replay failed")
+			os.Exit(1)
+		}
+	} else if api != nil {
+		<-api.ctx.Done()
+		api.wait()
+	} else if *watchCmd {
+		if err := watch(*udid, outputs, options); err != nil {
+			printErrJSON(err, "Invalid watch arguments")
+			os.Exit(1)
+		}
 	} else if *pullCmd {
-		gopull(*pushSpec, *file, *udid)
+		targets, err := pullTargets(*udid, *allDevices, outputs, deviceConfigs)
+		if err != nil {
+			printErrJSON(err, "Invalid pull arguments")
+			os.Exit(1)
+		}
+		gopull(targets, options)
 	} else {
 		flag.Usage()
 	}
@@ -78,234 +278,495 @@ func devices() {
 //      return stripCtlFromBytes(str)
 //}
 
-func gopull(pushSpec string, filename string, udid string) {
-	stopChannel := make(chan interface{})
-	stopChannel2 := make(chan interface{})
-	stopChannel3 := make(chan bool)
-	waitForSigInt(stopChannel, stopChannel2, stopChannel3)
+// pullTarget describes a device to pull and where its stream goes to.
+type pullTarget struct {
+	udid       string
+	pushSpec   string
+	file       string
+	audioFile  string
+	captureUsb string
+	mp4File    string
+	hlsDir     string
+}
 
-	var writer screencapture.CmSampleBufConsumer
+// udidPlaceholder is replaced by the device udid in push specs and file names.
+const udidPlaceholder = "{udid}"
 
-	pr, pw = io.Pipe()
-	fileMode = true
+// sharesFiles reports whether both targets write a file or directory of the same name.
+func (t pullTarget) sharesFiles(other pullTarget) bool {
+	names := map[string]bool{}
+	for _, name := range []string{t.file, t.audioFile, t.captureUsb, t.mp4File, t.hlsDir} {
+		if name != "" {
+			names[filepath.Clean(name)] = true
+		}
+	}
+	for _, name := range []string{other.file, other.audioFile, other.captureUsb, other.mp4File, other.hlsDir} {
+		if name != "" && names[filepath.Clean(name)] {
+			return true
+		}
+	}
+	return false
+}
 
-	//buf = new(bytes.Buffer)
+// namesDevice reports whether an output contains the udid placeholder.
+func (t pullTarget) namesDevice() bool {
+	for _, output := range []string{t.pushSpec, t.file, t.audioFile, t.captureUsb, t.mp4File, t.hlsDir} {
+		if strings.Contains(output, udidPlaceholder) {
+			return true
+		}
+	}
+	return false
+}
 
-	if filename == "" {
-		pushSock = setupSockets(pushSpec)
-		writer = NewStreamReceiver(pushSock, pw)
-		fileMode = false
-	} else {
-		fh, err := os.Create(filename)
+// pullTargets returns the targets of the devices to pull, the push specs of the config file are applied later.
+func pullTargets(udidList string, all bool, outputs pullTarget, deviceConfigs map[string]deviceSettings) ([]pullTarget, error) {
+	udids := splitList(udidList)
+	if all {
+		deviceList, err := mirror.FindIosDevices()
 		if err != nil {
-			log.Errorf("Error creating file %s:%s", filename, err)
+			return nil, err
+		}
+		if len(deviceList) == 0 {
+			return nil, errors.New("no iOS devices are connected to this host")
+		}
+		udids = nil
+		for _, device := range deviceList {
+			udids = append(udids, device.SerialNumber)
+		}
+	}
+	if len(udids) == 0 {
+		udids = []string{""}
+		if len(deviceConfigs) > 0 || outputs.namesDevice() {
+			// the outputs or the config file need the udid, so the device the session would pick is looked up now
+			device, err := mirror.FindIosDevice("")
+			if err != nil {
+				return nil, err
+			}
+			udids = []string{device.SerialNumber}
 		}
-		writer = NewFileReceiver(bufio.NewWriter(fh))
 	}
 
-	attempt := 1
-	for {
-		success := startWithConsumer(writer, udid, stopChannel, stopChannel2)
-		if success {
-			break
+	specs := splitList(outputs.pushSpec)
+	if len(specs) == 0 {
+		specs = []string{""}
+	}
+	if len(specs) > 1 && len(specs) != len(udids) {
+		return nil, fmt.Errorf("got %d push specs for %d devices", len(specs), len(udids))
+	}
+	// devices with a push spec in the config file do not use the shared one
+	sharing := 0
+	for _, udid := range udids {
+		if deviceConfigs[udid].PushSpec == nil {
+			sharing++
 		}
-		fmt.Printf("Attempt %d to start streaming\n", attempt)
-		if attempt >= 4 {
-			log.WithFields(log.Fields{
-				"type": "stream_start_failed",
-			}).Fatal("Socket new error")
+	}
+	if sharing > 1 && len(specs) == 1 && specs[0] != "" && !strings.Contains(specs[0], udidPlaceholder) {
+		return nil, fmt.Errorf("several devices need a push spec each or a push spec containing %s", udidPlaceholder)
+	}
+	for _, output := range []struct{ name, filename string }{
+		{"file", outputs.file},
+		{"audio file", outputs.audioFile},
+		{"usb capture file", outputs.captureUsb},
+		{"mp4 file", outputs.mp4File},
+		{"hls directory", outputs.hlsDir},
+	} {
+		if len(udids) > 1 && output.filename != "" && !strings.Contains(output.filename, udidPlaceholder) {
+			return nil, fmt.Errorf("several devices need a %s name containing %s", output.name, udidPlaceholder)
 		}
-		attempt++
-		time.Sleep(time.Second * 1)
 	}
 
-	<-stopChannel3
-	writer.Stop()
+	targets := make([]pullTarget, len(udids))
+	for i, udid := range udids {
+		spec := specs[0]
+		if len(specs) > 1 {
+			spec = specs[i]
+		}
+		targets[i] = pullTarget{
+			udid:       udid,
+			pushSpec:   strings.ReplaceAll(spec, udidPlaceholder, udid),
+			file:       strings.ReplaceAll(outputs.file, udidPlaceholder, udid),
+			audioFile:  strings.ReplaceAll(outputs.audioFile, udidPlaceholder, udid),
+			captureUsb: strings.ReplaceAll(outputs.captureUsb, udidPlaceholder, udid),
+			mp4File:    strings.ReplaceAll(outputs.mp4File, udidPlaceholder, udid),
+			hlsDir:     strings.ReplaceAll(outputs.hlsDir, udidPlaceholder, udid),
+		}
+	}
+	return targets, nil
 }
 
-func setupSockets(pushSpec string) (pushSock mangos.Socket) {
-	var err error
-	if pushSock, err = push.NewSocket(); err != nil {
-		log.WithFields(log.Fields{
-			"type": "err_socket_new",
-			"spec": pushSpec,
-			"err":  err,
-		}).Fatal("Socket new error")
+func splitList(list string) []string {
+	var result []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
 	}
-	if err = pushSock.Dial(pushSpec); err != nil {
-		log.WithFields(log.Fields{
-			"type": "err_socket_connect",
-			"spec": pushSpec,
-			"err":  err,
-		}).Fatal("Socket connect error")
+	return result
+}
+
+func gopull(targets []pullTarget, options pullOptions) {
+	ctx, stop := shutdownContext()
+	defer stop()
+
+	var wg sync.WaitGroup
+	failed := make(chan error, len(targets))
+	for _, target := range targets {
+		wg.Add(1)
+		go func(target pullTarget) {
+			defer wg.Done()
+			err := pullDevice(ctx, target, options)
+			if err != nil && ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+				// a shutdown signal arrived while the device was activated
+				return
+			}
+			if err != nil {
+				printErrJSON(err, fmt.Sprintf("Pulling device '%s' failed", target.udid))
+				failed <- err
+			}
+		}(target)
 	}
+	wg.Wait()
 
-	return pushSock
+	if len(failed) > 0 && len(failed) == len(targets) && ctx.Err() == nil {
+		log.WithFields(log.Fields{
+			"type": "stream_start_failed",
+			"err":  <-failed,
+		}).Fatal("No device could be pulled")
+	}
 }
 
-func startWithConsumer(consumer screencapture.CmSampleBufConsumer, udid string, stopChannel chan interface{}, stopChannel2 chan interface{}) bool {
-	device, err := FindIosDevice(udid)
+func pullDevice(ctx context.Context, target pullTarget, options pullOptions) error {
+	options, target = options.forDevice(target)
+	session, closeOutputs, err := deviceSession(target, options)
 	if err != nil {
-		printErrJSON(err, "no device found to activate")
-		return false
+		return err
 	}
-
-	device, err = EnableQTConfig(device)
-	if err != nil {
-		printErrJSON(err, "Error enabling QT config")
-		return false
+	defer closeOutputs()
+	if err := startSession(ctx, session); err != nil {
+		return err
 	}
 
-	adapter := UsbAdapter{}
-
-	mp := screencapture.NewMessageProcessor(&adapter, stopChannel, consumer, false)
+	go func() {
+		for err := range session.Errors() {
+			log.Errorf("Session failure - %s", err)
+		}
+	}()
 
-	err = startReading(&adapter, device, &mp, stopChannel2)
-	consumer.Stop()
-	if err != nil {
-		log.Errorf("startReading failure - %s", err)
-		log.Info("Closing device")
-		return false
+	select {
+	case <-ctx.Done():
+	case <-session.Done():
+		log.Infof("Session of device '%s' ended", session.Device().SerialNumber)
 	}
-	log.Info("Closing device")
-	return true
+	session.Stop()
+	return nil
 }
 
-func waitForSigInt(stopChannel chan interface{}, stopChannel2 chan interface{}, stopChannel3 chan bool) {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	go func() {
-		for sig := range c {
-			fmt.Printf("Got signal %s\n", sig)
-			go func() { stopChannel3 <- true }()
-			go func() {
-				stopChannel2 <- true
-				stopChannel2 <- true
-			}()
-			go func() {
-				stopChannel <- true
-				stopChannel <- true
-			}()
-
+// deviceSession creates the session of the target with all its outputs. closeOutputs flushes and closes the
+// files once the session ended.
+func deviceSession(target pullTarget, options pullOptions) (session *mirror.Session, closeOutputs func(), err error) {
+	var closers []func()
+	closeOutputs = func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			closers[i]()
+		}
+	}
+	config := options.sessionConfig()
+	config.Udid = target.udid
+	defer func() {
+		if err != nil {
+			// without a session nobody else closes the sinks
+			closeSinks(config.Sinks, config.VideoSinks)
+			closeOutputs()
 		}
 	}()
+
+	if target.file == "" {
+		videoSinks, err := options.videoSinks(target.pushSpec, target.hlsDir)
+		if err != nil {
+			return nil, nil, err
+		}
+		config.VideoSinks = videoSinks
+		sinks, err := options.sinks(target.pushSpec)
+		if err != nil {
+			return nil, nil, err
+		}
+		config.Sinks = sinks
+		config.SkipDecoding = len(sinks) == 0
+	} else {
+		// the h264 file replaces the push socket
+		videoSinks, err := options.videoSinks("", target.hlsDir)
+		if err != nil {
+			return nil, nil, err
+		}
+		config.VideoSinks = videoSinks
+		fileWriter, closeFile, err := createFile(target.file)
+		if err != nil {
+			return nil, nil, err
+		}
+		closers = append(closers, closeFile)
+		config.File = fileWriter
+	}
+	if target.audioFile != "" {
+		// wav headers are finalized by seeking back, so the file is written unbuffered
+		fh, err := os.Create(target.audioFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error creating file %s:%s", target.audioFile, err)
+		}
+		closers = append(closers, func() { _ = fh.Close() })
+		config.Audio = fh
+	}
+	if target.captureUsb != "" {
+		captureWriter, closeCapture, err := createFile(target.captureUsb)
+		if err != nil {
+			return nil, nil, err
+		}
+		closers = append(closers, closeCapture)
+		config.UsbCapture = captureWriter
+	}
+	if target.mp4File != "" {
+		mp4Writer, closeMp4, err := createFile(target.mp4File)
+		if err != nil {
+			return nil, nil, err
+		}
+		closers = append(closers, closeMp4)
+		config.Mp4 = mp4Writer
+	}
+	return mirror.NewSession(config), closeOutputs, nil
 }
 
-func startReading(usa *UsbAdapter, device IosDevice, receiver screencapture.UsbDataReceiver, stopSignal chan interface{}) error {
-	ctx, cleanUp := createContext()
-	defer cleanUp()
+// startSession starts the session, activating the QuickTime config sometimes needs a few attempts.
+func startSession(ctx context.Context, session *mirror.Session) error {
+	attempt := 1
+	for {
+		if ctx.Err() != nil {
+			session.Stop()
+			return ctx.Err()
+		}
+		err := session.Start(ctx)
+		if err == nil {
+			return nil
+		}
+		printErrJSON(err, "Error starting session")
+		fmt.Printf("Attempt %d to start streaming\n", attempt)
+		if attempt >= 4 {
+			session.Stop()
+			return err
+		}
+		attempt++
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+}
 
-	usbDevice, err := OpenDevice(ctx, device)
+// createFile returns a buffered writer for the new file and a function to flush and close it.
+func createFile(filename string) (*bufio.Writer, func(), error) {
+	fh, err := os.Create(filename)
 	if err != nil {
-		return err
+		return nil, nil, fmt.Errorf("error creating file %s:%s", filename, err)
+	}
+	writer := bufio.NewWriter(fh)
+	return writer, func() {
+		if err := writer.Flush(); err != nil {
+			log.Errorf("Error flushing file %s:%s", filename, err)
+		}
+		_ = fh.Close()
+	}, nil
+}
+
+func watch(udidList string, outputs pullTarget, options pullOptions) error {
+	// the recordings of several devices would share one file
+	if outputs.file != "" || outputs.audioFile != "" || outputs.mp4File != "" || outputs.captureUsb != "" {
+		return errors.New("-file, -audioFile, -mp4 and -captureUsb are not supported with -watch")
 	}
-	if !device.IsActivated() {
-		return errors.New("device not activated for screen mirroring")
+	if outputs.pushSpec != "" && !strings.Contains(outputs.pushSpec, udidPlaceholder) {
+		return fmt.Errorf("watching devices needs a push spec containing %s", udidPlaceholder)
 	}
-	confignum, _ := usbDevice.ActiveConfigNum()
+	if outputs.hlsDir != "" && !strings.Contains(outputs.hlsDir, udidPlaceholder) {
+		return fmt.Errorf("watching devices needs a hls directory containing %s", udidPlaceholder)
+	}
+	udids := splitList(udidList)
 
-	log.Debugf("Config is active: %d, QT config is: %d", confignum, device.QTConfigIndex)
+	ctx, stop := shutdownContext()
+	defer stop()
 
-	config, err := usbDevice.Config(device.QTConfigIndex)
-	if err != nil {
-		return errors.New("Could not retrieve config")
+	supervisor := mirror.NewSupervisor(mirror.SupervisorConfig{
+		SessionConfig: func(device mirror.IosDevice) (mirror.Config, bool) {
+			if len(udids) > 0 && !containsString(udids, device.SerialNumber) {
+				return mirror.Config{}, false
+			}
+			options, target := options.forDevice(pullTarget{
+				udid:     device.SerialNumber,
+				pushSpec: strings.ReplaceAll(outputs.pushSpec, udidPlaceholder, device.SerialNumber),
+				hlsDir:   strings.ReplaceAll(outputs.hlsDir, udidPlaceholder, device.SerialNumber),
+			})
+			videoSinks, err := options.videoSinks(target.pushSpec, target.hlsDir)
+			if err != nil {
+				return mirror.Config{}, false
+			}
+			sinks, err := options.sinks(target.pushSpec)
+			if err != nil {
+				closeSinks(nil, videoSinks)
+				return mirror.Config{}, false
+			}
+			config := options.sessionConfig()
+			config.Sinks = sinks
+			config.VideoSinks = videoSinks
+			config.SkipDecoding = len(sinks) == 0
+			return config, true
+		},
+		Status: options.status,
+	})
+	go supervisor.Run(ctx)
+
+	for event := range supervisor.Events() {
+		fields := log.Fields{
+			"type": string(event.Type),
+			"udid": event.Udid,
+		}
+		if event.Err != nil {
+			fields["err"] = event.Err.Error()
+		}
+		log.WithFields(fields).Info("Supervisor event")
+
+		if event.Type == mirror.SessionStarted {
+			go func(session *mirror.Session) {
+				for err := range session.Errors() {
+					log.Errorf("Session failure - %s", err)
+				}
+			}(event.Session)
+		}
 	}
+	return nil
+}
 
-	log.Debugf("QT Config is active: %s", config.String())
+// replaySource describes a recording that is decoded instead of the stream of a device.
+type replaySource struct {
+	file string
+	// usb marks file as usb capture written with -captureUsb instead of a h264 file.
+	usb      bool
+	fps      float64
+	realtime bool
+}
 
-	val, err := usbDevice.Control(0x02, 0x01, 0, 0x86, make([]byte, 0))
-	if err != nil {
-		log.Debug("failed control", err)
+// checkOutputs rejects outputs a replay can not feed. Replayed h264 files are decoded right away, so they only
+// reach frame sinks and have to have one that takes the frames.
+func (source replaySource) checkOutputs(outputs pullTarget, options pullOptions) error {
+	if source.usb {
+		// usb captures pass the receiver like a device, without frame sinks nothing is decoded
+		return nil
 	}
-	log.Debugf("Clear Feature RC: %d", val)
-
-	val, err = usbDevice.Control(0x02, 0x01, 0, 0x05, make([]byte, 0))
-	if err != nil {
-		log.Debug("failed control", err)
+	if outputs.pushSpec != "" && options.format == formatH264 || outputs.hlsDir != "" || options.rtsp != nil {
+		return errors.New("-format h264, -hls and -rtsp take the stream of -replayUsb, a replayed h264 file is decoded into frames")
 	}
-	log.Debugf("Clear Feature RC: %d", val)
-
-	iface, err := grabQuickTimeInterface(config)
-	if err != nil {
-		log.Debug("could not get Quicktime Interface")
-		return err
+	if (outputs.pushSpec == "" || options.format != formatJpeg) && options.mjpeg == nil && options.webSocket == nil {
+		return errors.New("a replayed h264 file needs -pushSpec with -format jpeg or -http to send its frames to")
 	}
-	log.Debugf("Got QT iface:%s", iface.String())
+	return nil
+}
 
-	inboundBulkEndpointIndex, err := grabInBulk(iface.Setting)
-	if err != nil {
+func replay(source replaySource, outputs pullTarget, options pullOptions) error {
+	if err := source.checkOutputs(outputs, options); err != nil {
 		return err
 	}
-	inEndpoint, err := iface.InEndpoint(inboundBulkEndpointIndex)
+	filename := source.file
+	fh, err := os.Open(filename)
 	if err != nil {
-		log.Error("couldnt get InEndpoint")
 		return err
 	}
-	log.Debugf("Inbound Bulk: %s", inEndpoint.String())
+	defer fh.Close()
 
-	outboundBulkEndpointIndex, err := grabOutBulk(iface.Setting)
+	videoSinks, err := options.videoSinks(outputs.pushSpec, outputs.hlsDir)
 	if err != nil {
 		return err
 	}
-	outEndpoint, err := iface.OutEndpoint(outboundBulkEndpointIndex)
+	sinks, err := options.sinks(outputs.pushSpec)
 	if err != nil {
-		log.Error("couldnt get OutEndpoint")
+		closeSinks(nil, videoSinks)
 		return err
 	}
-	log.Debugf("Outbound Bulk: %s", outEndpoint.String())
-
-	usa.outEndpoint = outEndpoint
+	config := options.sessionConfig()
+	config.Sinks = sinks
+	config.VideoSinks = videoSinks
+	if source.usb {
+		config.UsbReplay = fh
+		config.UsbReplayRealtime = source.realtime
+		config.SkipDecoding = len(sinks) == 0
+	} else {
+		config.Replay = bufio.NewReader(fh)
+		config.ReplayFps = source.fps
+	}
+	session := mirror.NewSession(config)
 
-	stream, err := inEndpoint.NewStream(4096, 5)
-	if err != nil {
-		log.Fatal("couldnt create stream")
+	ctx, stop := shutdownContext()
+	defer stop()
+	if err = session.Start(ctx); err != nil {
+		// closes the sinks of the session that never started
+		session.Stop()
 		return err
 	}
-	log.Debug("Endpoint claimed")
-	log.Infof("Device '%s' USB connection ready, waiting for ping..", device.SerialNumber)
 
+	lastErr := make(chan error, 1)
 	go func() {
-		for {
-			buffer := make([]byte, 4)
-
-			n, err := io.ReadFull(stream, buffer)
-			if err != nil {
-				log.Errorf("Failed reading 4bytes length with err:%s only received: %d", err, n)
-				return
-			}
-
-			//the 4 bytes header are included in the length, so we need to subtract them
-			//here to know how long the payload will be
-			length := binary.LittleEndian.Uint32(buffer) - 4
-			dataBuffer := make([]byte, length)
-
-			n, err = io.ReadFull(stream, dataBuffer)
-			if err != nil {
-				log.Errorf("Failed reading payload with err:%s only received: %d/%d bytes", err, n, length)
-				return
-			}
-			receiver.ReceiveData(dataBuffer)
+		var last error
+		for err := range session.Errors() {
+			log.Errorf("Session failure - %s", err)
+			last = err
 		}
+		lastErr <- last
 	}()
-	if !fileMode {
-		go h264ToJpeg()
-	}
-
-	<-stopSignal
-	receiver.CloseSession()
-	log.Info("Closing usb stream")
 
-	err = stream.Close()
-	if err != nil {
-		log.Error("Error closing stream", err)
+	select {
+	case <-ctx.Done():
+	case <-session.Done():
+		log.Infof("Replay of %s finished", filename)
 	}
-	log.Info("Closing usb interface")
-	iface.Close()
+	session.Stop()
+	return <-lastErr
+}
 
-	log.Info("Closing config")
-	_ = config.Close()
+func containsString(list []string, item string) bool {
+	for _, entry := range list {
+		if entry == item {
+			return true
+		}
+	}
+	return false
+}
 
-	sendQTDisable(usbDevice)
+// shutdownSignals end the streaming commands, service managers like systemd and docker stop processes with SIGTERM.
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGHUP}
 
-	return nil
+// shutdownContext returns a context that is cancelled by the first shutdown signal, so that sessions disable the
+// QuickTime config of their devices before the process exits. A second signal exits right away, for devices that
+// hang while they are released. stop releases the signals again.
+func shutdownContext() (ctx context.Context, stop context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan os.Signal, 1)
+	stopped := make(chan struct{})
+	signal.Notify(c, shutdownSignals...)
+	go func() {
+		select {
+		case sig := <-c:
+			fmt.Printf("Got signal %s\n", sig)
+			cancel()
+		case <-stopped:
+			return
+		}
+		select {
+		case sig := <-c:
+			fmt.Printf("Got signal %s again, exiting without releasing the devices\n", sig)
+			os.Exit(1)
+		case <-stopped:
+		}
+	}()
+	var once sync.Once
+	return ctx, func() {
+		once.Do(func() {
+			signal.Stop(c)
+			close(stopped)
+		})
+		cancel()
+	}
 }
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/luke-cha/ios-screen-mirror/mirror"
+)
+
+func TestReplayCheckOutputs(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  replaySource
+		outputs pullTarget
+		options pullOptions
+		err     bool
+	}{
+		{name: "jpeg push", outputs: pullTarget{pushSpec: "tcp://127.0.0.1:7879"}, options: pullOptions{format: formatJpeg}},
+		{name: "http viewers", options: pullOptions{format: formatJpeg, mjpeg: &mirror.MjpegServer{}}},
+		{name: "no frame sinks", options: pullOptions{format: formatJpeg}, err: true},
+		{name: "h264 push", outputs: pullTarget{pushSpec: "tcp://127.0.0.1:7879"}, options: pullOptions{format: formatH264}, err: true},
+		{name: "hls", outputs: pullTarget{pushSpec: "tcp://127.0.0.1:7879", hlsDir: "www"}, options: pullOptions{format: formatJpeg}, err: true},
+		{name: "usb capture without frame sinks", source: replaySource{usb: true}, outputs: pullTarget{hlsDir: "www"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.source.checkOutputs(test.outputs, test.options); (err != nil) != test.err {
+				t.Errorf("got error %v", err)
+			}
+		})
+	}
+}
+
+func TestWatchRejectsRecordings(t *testing.T) {
+	tests := []struct {
+		name    string
+		outputs pullTarget
+	}{
+		{name: "h264 file", outputs: pullTarget{file: "record.h264"}},
+		{name: "audio file", outputs: pullTarget{audioFile: "record.wav"}},
+		{name: "mp4 file", outputs: pullTarget{mp4File: "record.mp4"}},
+		{name: "usb capture", outputs: pullTarget{captureUsb: "session.qtcap"}},
+		{name: "push spec without udid", outputs: pullTarget{pushSpec: "tcp://127.0.0.1:7879"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := watch("", test.outputs, pullOptions{}); err == nil {
+				t.Error("watch started")
+			}
+		})
+	}
+}
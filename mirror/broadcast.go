@@ -0,0 +1,107 @@
+package mirror
+
+import (
+	"sort"
+	"sync"
+)
+
+// broadcaster fans the messages of every device out to all clients subscribed to it.
+type broadcaster struct {
+	mu      sync.Mutex
+	streams map[string]*broadcastStream
+	// sendLatest hands the latest message of a device to new clients right away
+	sendLatest bool
+}
+
+type broadcastStream struct {
+	mu      sync.Mutex
+	clients map[chan []byte]struct{}
+	latest  []byte
+}
+
+// subscription receives the messages of one device, messages is closed when the device stream ended.
+type subscription struct {
+	stream   *broadcastStream
+	messages chan []byte
+}
+
+func newBroadcaster(sendLatest bool) *broadcaster {
+	return &broadcaster{streams: map[string]*broadcastStream{}, sendLatest: sendLatest}
+}
+
+func (b *broadcaster) udids() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	udids := make([]string, 0, len(b.streams))
+	for udid := range b.streams {
+		udids = append(udids, udid)
+	}
+	sort.Strings(udids)
+	return udids
+}
+
+// subscribe returns nil if no stream for the udid exists.
+func (b *broadcaster) subscribe(udid string) *subscription {
+	b.mu.Lock()
+	stream, ok := b.streams[udid]
+	b.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	sub := &subscription{stream: stream, messages: make(chan []byte, 1)}
+	stream.mu.Lock()
+	if b.sendLatest && stream.latest != nil {
+		sub.messages <- stream.latest
+	}
+	stream.clients[sub.messages] = struct{}{}
+	stream.mu.Unlock()
+	return sub
+}
+
+// publish hands the message to every client of the device, slow clients skip the message they did not pick up yet.
+func (b *broadcaster) publish(udid string, data []byte) {
+	b.mu.Lock()
+	stream, ok := b.streams[udid]
+	if !ok {
+		stream = &broadcastStream{clients: map[chan []byte]struct{}{}}
+		b.streams[udid] = stream
+	}
+	b.mu.Unlock()
+
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	stream.latest = data
+	for client := range stream.clients {
+		select {
+		case <-client:
+		default:
+		}
+		client <- data
+	}
+}
+
+// remove ends the stream of the device and disconnects its clients.
+func (b *broadcaster) remove(udid string) {
+	b.mu.Lock()
+	stream, ok := b.streams[udid]
+	delete(b.streams, udid)
+	b.mu.Unlock()
+	if !ok {
+		return
+	}
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	for client := range stream.clients {
+		delete(stream.clients, client)
+		close(client)
+	}
+}
+
+func (s *subscription) close() {
+	s.stream.mu.Lock()
+	defer s.stream.mu.Unlock()
+	if _, ok := s.stream.clients[s.messages]; ok {
+		delete(s.stream.clients, s.messages)
+		close(s.messages)
+	}
+}
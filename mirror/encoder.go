@@ -0,0 +1,161 @@
+package mirror
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"sync"
+)
+
+// ImageFormat names the encoding of the frames sent by a sink.
+type ImageFormat string
+
+const (
+	// ImageFormatJpeg is lossy and small, the quality is set with ImageEncoder.JpegQuality.
+	ImageFormatJpeg ImageFormat = "jpeg"
+	// ImageFormatPng is lossless, for example for visual regression tests.
+	ImageFormatPng ImageFormat = "png"
+	// ImageFormatRgba is the raw RGBA pixels, row by row without padding.
+	ImageFormatRgba ImageFormat = "rgba"
+	// ImageFormatYuv is the raw I420 planes, full resolution Y followed by U and V subsampled by two.
+	ImageFormatYuv ImageFormat = "yuv"
+)
+
+// ParseImageFormat returns the format of the given name, as used by the -imageFormat flag.
+func ParseImageFormat(name string) (ImageFormat, error) {
+	switch format := ImageFormat(name); format {
+	case ImageFormatJpeg, ImageFormatPng, ImageFormatRgba, ImageFormatYuv:
+		return format, nil
+	}
+	return "", fmt.Errorf("unknown image format '%s', use jpeg, png, rgba or yuv", name)
+}
+
+// ImageEncoder turns frames into the bytes a sink sends. The zero value encodes jpegs of default quality.
+type ImageEncoder struct {
+	Format ImageFormat
+	// JpegQuality ranges from 1 to 100, 0 uses the default quality of 75.
+	JpegQuality int
+}
+
+var pngEncoder = png.Encoder{CompressionLevel: png.BestSpeed}
+
+// Encode returns the image in the format of the encoder.
+func (e ImageEncoder) Encode(img *image.RGBA) ([]byte, error) {
+	switch e.Format {
+	case ImageFormatJpeg, "":
+		buf := new(bytes.Buffer)
+		var options *jpeg.Options
+		if e.JpegQuality > 0 {
+			options = &jpeg.Options{Quality: e.JpegQuality}
+		}
+		if err := jpeg.Encode(buf, img, options); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case ImageFormatPng:
+		buf := new(bytes.Buffer)
+		if err := pngEncoder.Encode(buf, img); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case ImageFormatRgba:
+		return rgbaPixels(img), nil
+	case ImageFormatYuv:
+		return i420Planes(img), nil
+	}
+	return nil, fmt.Errorf("unknown image format '%s'", e.Format)
+}
+
+// encodedImages shares the encoded images of one frame between the sinks it is sent to, so that the viewers
+// and the push socket encode every format only once.
+type encodedImages struct {
+	mu     sync.Mutex
+	images map[ImageEncoder][]byte
+}
+
+// encode returns the image of the frame in the format of the encoder, the returned bytes must not be modified.
+// Frames without encodedImages are encoded on every call.
+func (f Frame) encode(encoder ImageEncoder) ([]byte, error) {
+	if f.encoded == nil {
+		return encoder.Encode(f.Image)
+	}
+	key := ImageEncoder{Format: encoder.format(), JpegQuality: encoder.JpegQuality}
+	f.encoded.mu.Lock()
+	defer f.encoded.mu.Unlock()
+	if data, ok := f.encoded.images[key]; ok {
+		return data, nil
+	}
+	data, err := encoder.Encode(f.Image)
+	if err != nil {
+		return nil, err
+	}
+	if f.encoded.images == nil {
+		f.encoded.images = map[ImageEncoder][]byte{}
+	}
+	f.encoded.images[key] = data
+	return data, nil
+}
+
+func (e ImageEncoder) format() ImageFormat {
+	if e.Format == "" {
+		return ImageFormatJpeg
+	}
+	return e.Format
+}
+
+// ContentType returns the mime type of the encoded images.
+func (e ImageEncoder) ContentType() string {
+	switch e.Format {
+	case ImageFormatPng:
+		return "image/png"
+	case ImageFormatRgba, ImageFormatYuv:
+		return "application/octet-stream"
+	}
+	return "image/jpeg"
+}
+
+func rgbaPixels(img *image.RGBA) []byte {
+	bounds := img.Bounds()
+	rowSize := bounds.Dx() * 4
+	pixels := make([]byte, 0, rowSize*bounds.Dy())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		offset := img.PixOffset(bounds.Min.X, y)
+		pixels = append(pixels, img.Pix[offset:offset+rowSize]...)
+	}
+	return pixels
+}
+
+// i420Planes converts the image into full range BT.601 planes, the chroma of each 2x2 block is averaged.
+func i420Planes(img *image.RGBA) []byte {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	chromaWidth, chromaHeight := (width+1)/2, (height+1)/2
+	planes := make([]byte, width*height+2*chromaWidth*chromaHeight)
+	yPlane := planes[:width*height]
+	uPlane := planes[width*height : width*height+chromaWidth*chromaHeight]
+	vPlane := planes[width*height+chromaWidth*chromaHeight:]
+
+	for cy := 0; cy < chromaHeight; cy++ {
+		for cx := 0; cx < chromaWidth; cx++ {
+			var r, g, b, count int
+			for y := cy * 2; y < cy*2+2 && y < height; y++ {
+				for x := cx * 2; x < cx*2+2 && x < width; x++ {
+					pixel := img.Pix[img.PixOffset(bounds.Min.X+x, bounds.Min.Y+y):]
+					luma, _, _ := color.RGBToYCbCr(pixel[0], pixel[1], pixel[2])
+					yPlane[y*width+x] = luma
+					r += int(pixel[0])
+					g += int(pixel[1])
+					b += int(pixel[2])
+					count++
+				}
+			}
+			_, u, v := color.RGBToYCbCr(uint8(r/count), uint8(g/count), uint8(b/count))
+			uPlane[cy*chromaWidth+cx] = u
+			vPlane[cy*chromaWidth+cx] = v
+		}
+	}
+	return planes
+}
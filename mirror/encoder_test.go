@@ -0,0 +1,33 @@
+package mirror
+
+import (
+	"image"
+	"testing"
+)
+
+func TestFrameEncodesOncePerFormat(t *testing.T) {
+	frame := Frame{Image: image.NewRGBA(image.Rect(0, 0, 16, 16)), encoded: &encodedImages{}}
+	first, err := frame.encode(ImageEncoder{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		encoder ImageEncoder
+		shared  bool
+	}{
+		{name: "same encoder", encoder: ImageEncoder{}, shared: true},
+		{name: "default format", encoder: ImageEncoder{Format: ImageFormatJpeg}, shared: true},
+		{name: "other quality", encoder: ImageEncoder{JpegQuality: 90}},
+		{name: "other format", encoder: ImageEncoder{Format: ImageFormatPng}},
+	}
+	for _, test := range tests {
+		data, err := frame.encode(test.encoder)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if shared := &data[0] == &first[0]; shared != test.shared {
+			t.Errorf("%s: shared %t, want %t", test.name, shared, test.shared)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package mirror
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+)
+
+// EnvelopeVersion is the version of FrameHeader written into every envelope.
+const EnvelopeVersion = 1
+
+// Formats of envelopes that do not carry a single image.
+const (
+	// EnvelopeFormatTiles marks keyframe and delta messages as described by TileConfig.
+	EnvelopeFormatTiles = "tiles"
+	// EnvelopeFormatH264 marks access units in annex b format.
+	EnvelopeFormatH264 = "h264"
+)
+
+// FrameHeader describes the payload of an envelope. An envelope starts with the big endian uint32 length of
+// the JSON encoded header, followed by the header and the payload.
+type FrameHeader struct {
+	Version  int    `json:"version"`
+	Udid     string `json:"udid"`
+	Sequence uint64 `json:"sequence"`
+	// PresentationTime is the presentation timestamp of the CMSampleBuffer in microseconds.
+	PresentationTime int64 `json:"pts"`
+	// Timestamp is the capture wall time in unix milliseconds.
+	Timestamp int64 `json:"timestamp"`
+	Width     int   `json:"width"`
+	Height    int   `json:"height"`
+	// Orientation is OrientationPortrait or OrientationLandscape.
+	Orientation string `json:"orientation"`
+	// Format is an ImageFormat, EnvelopeFormatTiles or EnvelopeFormatH264.
+	Format string `json:"format"`
+	// ContentType is the mime type of the payload, for tiles the one of the tile images.
+	ContentType string `json:"contentType"`
+	// Score is the FastCompare result against the previous frame.
+	Score int64 `json:"score"`
+	// Keyframe is set for h264 access units with an IDR slice and tile keyframes.
+	Keyframe bool `json:"keyframe,omitempty"`
+}
+
+// frameHeader fills the header fields every frame envelope shares.
+func frameHeader(frame Frame, sequence uint64, format string, contentType string) FrameHeader {
+	return FrameHeader{
+		Version:          EnvelopeVersion,
+		Udid:             frame.Udid,
+		Sequence:         sequence,
+		PresentationTime: int64(frame.PresentationTime / time.Microsecond),
+		Timestamp:        frame.Time.UnixNano() / int64(time.Millisecond),
+		Width:            frame.Image.Bounds().Dx(),
+		Height:           frame.Image.Bounds().Dy(),
+		Orientation:      frame.Orientation,
+		Format:           format,
+		ContentType:      contentType,
+		Score:            frame.Score,
+	}
+}
+
+func envelope(header FrameHeader, payload []byte) ([]byte, error) {
+	data, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	message := make([]byte, 4, 4+len(data)+len(payload))
+	binary.BigEndian.PutUint32(message, uint32(len(data)))
+	message = append(message, data...)
+	return append(message, payload...), nil
+}
@@ -0,0 +1,399 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"time"
+
+	"github.com/3d0c/gmf"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultChangeThreshold is the FastCompare score a frame has to exceed to be emitted.
+const DefaultChangeThreshold = 500
+
+// ptsQueueSize is the number of presentation times queued for samples the decoder did not pick up yet
+const ptsQueueSize = 256
+
+// sampleTime is queued by IOSImageReceiver for every sample it hands to the decoder.
+type sampleTime struct {
+	pts time.Duration
+	// received is when the sample arrived over usb
+	received time.Time
+}
+
+// decoder turns the annex b stream written by IOSImageReceiver into scaled RGBA frames.
+// Frames that do not differ enough from the previously emitted one are dropped.
+type decoder struct {
+	pr              *io.PipeReader
+	screenRatio     float64
+	scale           ScaleConfig
+	changeThreshold int64
+	frames          chan<- Frame
+	prevImg         *image.RGBA
+	// pts delivers the presentation time of every sample in decoding order, nil for replayed streams
+	pts     <-chan sampleTime
+	metrics *deviceMetrics
+}
+
+func newDecoder(pr *io.PipeReader, screenRatio float64, scale ScaleConfig, changeThreshold int64, frames chan<- Frame) *decoder {
+	return &decoder{pr: pr, screenRatio: screenRatio, scale: scale, changeThreshold: changeThreshold, frames: frames}
+}
+
+// h264ToJpeg decodes the stream until it ends or ctx is cancelled, pictures still queued are dropped then.
+func (d *decoder) h264ToJpeg(ctx context.Context) error {
+	inputCtx := gmf.NewCtx()
+	defer inputCtx.Close()
+
+	avioCtx, err := gmf.NewAVIOContext(inputCtx, &gmf.AVIOHandlers{ReadPacket: d.reader})
+	if err != nil {
+		return err
+	}
+	defer gmf.Release(avioCtx)
+	_ = inputCtx.SetPb(avioCtx).OpenInput("")
+
+	srcVideoStream, err := inputCtx.GetBestStream(gmf.AVMEDIA_TYPE_VIDEO)
+	if err != nil {
+		log.Printf("No video stream found ")
+		return nil
+	}
+
+	ist, err := inputCtx.GetStream(srcVideoStream.Index())
+	if err != nil {
+		return fmt.Errorf("error getting stream - %s", err)
+	}
+	defer ist.Free()
+
+	// the scaler is created for the first decoded picture and rebuilt whenever the device
+	// changes its resolution or orientation
+	var scale *scaler
+	defer func() {
+		if scale != nil {
+			scale.free()
+		}
+	}()
+
+	start := time.Now()
+
+	var (
+		pkt        *gmf.Packet
+		frames     []*gmf.Frame
+		drain      int = -1
+		frameCount int = 0
+		// pictures decoded before the first IDR slice may miss their references
+		keyframeSeen bool
+	)
+
+	for {
+		if drain >= 0 || ctx.Err() != nil {
+			break
+		}
+
+		pkt, err = inputCtx.GetNextPacket()
+		if err != nil && err != io.EOF {
+			if pkt != nil {
+				pkt.Free()
+			}
+			log.Printf("error getting next packet - %s", err)
+			break
+		} else if err != nil && pkt == nil {
+			drain = 0
+		}
+
+		if pkt != nil && pkt.StreamIndex() != srcVideoStream.Index() {
+			continue
+		}
+
+		frames, err = ist.CodecCtx().Decode(pkt)
+		if err != nil {
+			log.Printf("Fatal error during decoding - %s\n", err)
+			break
+		}
+
+		// Decode() method doesn't treat EAGAIN and EOF as errors
+		// it returns empty frames slice instead. Countinue until
+		// input EOF or frames received.
+		if len(frames) == 0 && drain < 0 {
+			continue
+		}
+
+		for _, frame := range frames {
+			d.metrics.add(counterFramesDecoded, 1)
+			sample := d.nextSample()
+			if !sample.received.IsZero() {
+				d.metrics.observeLatency(stageDecode, time.Since(sample.received))
+			}
+			if !keyframeSeen {
+				if frame.KeyFrame() == 0 {
+					frame.Free()
+					continue
+				}
+				keyframeSeen = true
+			}
+			if scale == nil || !scale.fits(frame) {
+				next, err := newScaler(ist, frame.Width(), frame.Height(), int32(frame.Format()), d.scale.layout(frame.Width(), frame.Height(), d.screenRatio), d.scale.Algorithm)
+				if err != nil {
+					return err
+				}
+				if scale != nil {
+					log.WithFields(log.Fields{
+						"type":   "resolution_changed",
+						"width":  frame.Width(),
+						"height": frame.Height(),
+					}).Info("Video resolution changed")
+					// hand out what the old encoder still holds before it is replaced
+					if err = d.encode(ctx, scale, nil, 0, 0); err != nil {
+						return err
+					}
+					scale.free()
+				}
+				scale = next
+			}
+
+			scaleStart := time.Now()
+			pictures := []*gmf.Frame{frame}
+			if scale.crop != nil {
+				if pictures, err = scale.cropPicture(frame); err != nil {
+					return err
+				}
+			}
+			scaled, err := gmf.DefaultRescaler(scale.swsCtx, pictures)
+			if err != nil {
+				return err
+			}
+			d.metrics.observeLatency(stageScale, time.Since(scaleStart))
+			if err = d.encode(ctx, scale, scaled, drain, sample.pts); err != nil {
+				return err
+			}
+			for i := range scaled {
+				scaled[i].Free()
+				frameCount++
+			}
+		}
+		if len(frames) == 0 && scale != nil {
+			if err = d.encode(ctx, scale, nil, drain, 0); err != nil {
+				return err
+			}
+		}
+
+		if pkt != nil {
+			pkt.Free()
+			pkt = nil
+		}
+	}
+
+	for i := 0; i < inputCtx.StreamsCnt(); i++ {
+		st, _ := inputCtx.GetStream(i)
+		st.CodecCtx().Free()
+		st.Free()
+	}
+
+	since := time.Since(start)
+	log.Printf("Finished in %v, avg %.2f fps", since, float64(frameCount)/since.Seconds())
+	return nil
+}
+
+// scaler converts decoded pictures of one size and pixel format into RGBA pictures of the frame layout.
+type scaler struct {
+	width  int
+	height int
+	pixFmt int32
+	// crop cuts the crop of the layout out of the decoded pictures before they are scaled, nil keeps them whole
+	crop   *gmf.Filter
+	swsCtx *gmf.SwsCtx
+	cc     *gmf.CodecCtx
+}
+
+// newScaler creates the scaler for the pictures decoded from stream, which have the given size and pixel format.
+func newScaler(stream *gmf.Stream, width int, height int, pixFmt int32, layout frameLayout, algorithm ScaleAlgorithm) (*scaler, error) {
+	codec, err := gmf.FindEncoder(gmf.AV_CODEC_ID_RAWVIDEO)
+	if err != nil {
+		return nil, err
+	}
+
+	cc := gmf.NewCodecCtx(codec)
+	cc.SetTimeBase(gmf.AVR{Num: 1, Den: 1})
+	cc.SetPixFmt(gmf.AV_PIX_FMT_RGBA).SetWidth(layout.width).SetHeight(layout.height)
+	if codec.IsExperimental() {
+		cc.SetStrictCompliance(gmf.FF_COMPLIANCE_EXPERIMENTAL)
+	}
+
+	if err := cc.Open(nil); err != nil {
+		cc.Free()
+		return nil, err
+	}
+
+	s := &scaler{width: width, height: height, pixFmt: pixFmt, cc: cc}
+	srcWidth, srcHeight, srcPixFmt := width, height, pixFmt
+	if !layout.crop.Empty() {
+		rect := layout.crop
+		crop, err := gmf.NewFilter(fmt.Sprintf("crop=%d:%d:%d:%d", rect.Dx(), rect.Dy(), rect.Min.X, rect.Min.Y), []*gmf.Stream{stream}, nil, nil)
+		if err != nil {
+			if crop != nil {
+				crop.Release()
+			}
+			cc.Free()
+			return nil, fmt.Errorf("error creating crop filter - %s", err)
+		}
+		s.crop = crop
+		// the filter graph of gmf always puts out yuv420p
+		srcWidth, srcHeight, srcPixFmt = rect.Dx(), rect.Dy(), gmf.AV_PIX_FMT_YUV420P
+	}
+
+	// convert source pix_fmt into AV_PIX_FMT_RGBA
+	// which is set up by codec context above
+	swsCtx, err := gmf.NewSwsCtx(srcWidth, srcHeight, srcPixFmt, cc.Width(), cc.Height(), cc.PixFmt(), algorithm.swsFlags())
+	if err != nil {
+		if s.crop != nil {
+			s.crop.Release()
+		}
+		cc.Free()
+		return nil, err
+	}
+	s.swsCtx = swsCtx
+	return s, nil
+}
+
+// cropPicture cuts the crop out of the decoded picture and releases it.
+func (s *scaler) cropPicture(frame *gmf.Frame) ([]*gmf.Frame, error) {
+	defer frame.Free()
+	if err := s.crop.AddFrame(frame, 0, gmf.AV_BUFFERSRC_FLAG_PUSH); err != nil {
+		return nil, fmt.Errorf("error cropping - %s", err)
+	}
+	// GetFrame also returns why it stopped reading, which is EAGAIN once the cropped picture was read
+	cropped, _ := s.crop.GetFrame()
+	return cropped, nil
+}
+
+// fits reports whether the decoded frame has the size and pixel format the scaler was created for.
+func (s *scaler) fits(frame *gmf.Frame) bool {
+	return frame.Width() == s.width && frame.Height() == s.height && int32(frame.Format()) == s.pixFmt
+}
+
+func (s *scaler) free() {
+	if s.crop != nil {
+		s.crop.Release()
+	}
+	s.swsCtx.Free()
+	s.cc.Free()
+}
+
+func (d *decoder) reader() ([]byte, int) {
+	var (
+		err       error
+		bytesread int
+	)
+
+	pos := 0
+	buf := make([]byte, 50000)
+	for {
+		bytesread, err = d.pr.Read(buf[pos:])
+		if bytesread > 0 {
+			pos += bytesread
+		}
+
+		if pos >= len(buf) || pos > 0 {
+			//log.Printf("read: %d\n", len(buf[:pos]))
+			pos = 0
+			break
+		}
+
+		if err != nil {
+			if err != io.EOF {
+				log.Println(err)
+			}
+			break
+		}
+	}
+
+	return buf, bytesread
+}
+
+// nextSample returns the timing of the sample of the next decoded picture, the zero value if it is unknown.
+func (d *decoder) nextSample() sampleTime {
+	select {
+	case sample := <-d.pts:
+		return sample
+	default:
+		return sampleTime{}
+	}
+}
+
+// pushSample queues the timing of a sample, the oldest one is dropped if the decoder fell behind.
+func pushSample(queue chan sampleTime, sample sampleTime) {
+	for {
+		select {
+		case queue <- sample:
+			return
+		default:
+		}
+		select {
+		case <-queue:
+		default:
+		}
+	}
+}
+
+func (d *decoder) encode(ctx context.Context, scale *scaler, frames []*gmf.Frame, drain int, presentationTime time.Duration) error {
+	packets, err := scale.cc.Encode(frames, drain)
+	if err != nil {
+		return fmt.Errorf("error encoding - %s", err)
+	}
+	if len(packets) == 0 {
+		return nil
+	}
+
+	for i, p := range packets {
+		width, height := scale.cc.Width(), scale.cc.Height()
+
+		img := new(image.RGBA)
+		img.Pix = p.Data()
+		img.Stride = 4 * width
+		img.Rect = image.Rect(0, 0, width, height)
+
+		result := int64(0)
+
+		// a frame of another size, the device rotated or changed its resolution, is always emitted
+		changed := d.prevImg == nil || d.prevImg.Bounds() != img.Bounds()
+		if !changed {
+			compareStart := time.Now()
+			if result, err = FastCompare(img, d.prevImg); err != nil {
+				p.Free()
+				return err
+			}
+			d.metrics.observeLatency(stageCompare, time.Since(compareStart))
+		}
+
+		if result > d.changeThreshold || changed {
+			log.Debugf("compare result : %d\n", result)
+			frame := Frame{
+				Image:            img,
+				Score:            result,
+				Orientation:      orientationOf(scale.width, scale.height),
+				PresentationTime: presentationTime,
+				Time:             time.Now(),
+			}
+			select {
+			case d.frames <- frame:
+			case <-ctx.Done():
+				// nobody has to take the frames of a stopped session
+				for _, rest := range packets[i:] {
+					rest.Free()
+				}
+				return nil
+			}
+			d.prevImg = img
+			d.metrics.add(counterFramesEmitted, 1)
+		} else {
+			d.metrics.add(counterFramesSuppressed, 1)
+		}
+
+		p.Free()
+		continue
+	}
+
+	return nil
+}
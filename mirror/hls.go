@@ -0,0 +1,396 @@
+package mirror
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	hlsPlaylistName = "index.m3u8"
+	hlsInitName     = "init.mp4"
+	// segments are kept on disk a little longer than they are listed, for clients still downloading them
+	hlsKeepExtraSegments = 2
+	// parts are only listed for the most recent segments, as LL-HLS asks for
+	hlsPartSegments = 3
+)
+
+// HlsConfig contains the settings of a HlsSink.
+type HlsConfig struct {
+	// SegmentDuration is the minimum length of a segment, segments are cut at the first key frame after it.
+	// Segments without a key frame are cut once they would get longer than twice SegmentDuration, rounded up
+	// to full seconds, which is the target duration of the playlist. Defaults to two seconds.
+	SegmentDuration time.Duration
+	// PlaylistSize is the number of segments listed in the playlist, defaults to 6.
+	PlaylistSize int
+	// PartDuration enables low latency HLS partial segments of at most this length, 0 disables them.
+	// Parts are cut before the access unit that is expected to make them longer. A single picture lasting
+	// longer, as on a static screen, ends at the end of its part and the next picture follows after a gap.
+	PartDuration time.Duration
+}
+
+// HlsSink cuts the h264 stream of a session into fragmented mp4 segments at key frames and keeps a rolling
+// index.m3u8 playlist next to them, so that any static http server can serve the directory. The files are
+// written by a goroutine of the sink, if it does not keep up access units are dropped up to the next key frame.
+type HlsSink struct {
+	dir    string
+	config HlsConfig
+	units  chan AccessUnit
+	done   chan struct{}
+	// waitKeyframe is set after units were dropped, only used by SendVideo
+	waitKeyframe bool
+	// closeErr is the error of writing the last segment, set before done is closed
+	closeErr error
+
+	// the fields below are only used by the writing goroutine
+	sps      []byte
+	pps      []byte
+	started  bool
+	firstPts time.Duration
+	sequence uint32
+
+	// pending holds the samples of the current part, the duration of the last one is set by its successor
+	pending  []mp4Sample
+	current  hlsSegment
+	segments []hlsSegment
+	// targetDuration is the longest a segment gets in seconds, it can not change once the playlist was published
+	targetDuration int
+}
+
+type hlsSegment struct {
+	index int
+	// start is the presentation time of the first sample in mp4 ticks
+	start    uint64
+	duration time.Duration
+	data     bytes.Buffer
+	parts    []hlsPart
+}
+
+type hlsPart struct {
+	name        string
+	duration    time.Duration
+	independent bool
+}
+
+// NewHlsSink creates the directory if needed, files of a previous run in it are overwritten.
+func NewHlsSink(dir string, config HlsConfig) (*HlsSink, error) {
+	if config.SegmentDuration <= 0 {
+		config.SegmentDuration = 2 * time.Second
+	}
+	if config.PlaylistSize <= 0 {
+		config.PlaylistSize = 6
+	}
+	if config.PartDuration >= config.SegmentDuration {
+		return nil, errors.New("hls parts have to be shorter than segments")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	h := &HlsSink{
+		dir:            dir,
+		config:         config,
+		units:          make(chan AccessUnit, 64),
+		done:           make(chan struct{}),
+		targetDuration: int(math.Ceil(2 * config.SegmentDuration.Seconds())),
+	}
+	go h.write()
+	return h, nil
+}
+
+// SendVideo queues the access unit, the stream starts with the first key frame.
+func (h *HlsSink) SendVideo(unit AccessUnit) error {
+	if h.waitKeyframe {
+		if !unit.Keyframe {
+			return nil
+		}
+		h.waitKeyframe = false
+	}
+	select {
+	case h.units <- unit:
+		return nil
+	default:
+		h.waitKeyframe = true
+		return errors.New("hls writer too slow, skipping to the next key frame")
+	}
+}
+
+// Close writes the queued access units and the remaining samples as last segment and ends the playlist.
+func (h *HlsSink) Close() error {
+	close(h.units)
+	<-h.done
+	return h.closeErr
+}
+
+func (h *HlsSink) write() {
+	defer close(h.done)
+	for unit := range h.units {
+		if err := h.writeUnit(unit); err != nil {
+			log.Warnf("Failed writing hls of '%s': %s", unit.Udid, err)
+		}
+	}
+	h.closeErr = h.finish()
+}
+
+// writeUnit adds the access unit to the current segment and writes the parts and segments it completes.
+func (h *HlsSink) writeUnit(unit AccessUnit) error {
+	if !h.started {
+		if !unit.Keyframe || len(unit.SPS) < 4 || len(unit.PPS) == 0 {
+			return nil
+		}
+		h.sps = unit.SPS
+		h.pps = unit.PPS
+		if err := h.writeFile(hlsInitName, mp4InitSegment(unit.SPS, unit.PPS, uint32(unit.Width), uint32(unit.Height))); err != nil {
+			return err
+		}
+		h.started = true
+		h.firstPts = unit.PresentationTime
+	} else if unit.Keyframe && (!bytes.Equal(unit.SPS, h.sps) || !bytes.Equal(unit.PPS, h.pps)) {
+		log.Warn("Video format changed, the hls stream keeps the format it was started with")
+	}
+
+	pts := unit.PresentationTime - h.firstPts
+	if pts < 0 {
+		pts = 0
+	}
+	ticks := durationToTicks(pts)
+
+	if n := len(h.pending); n > 0 {
+		last := &h.pending[n-1]
+		duration := uint64(defaultSampleDuration)
+		if ticks > last.pts {
+			duration = ticks - last.pts
+		}
+		h.endLastSample(duration)
+		// measured on the timestamps, the sample durations are rounded
+		segmentDuration := ticksToDuration(ticks - h.current.start)
+		segmentFull := ticks-h.current.start+uint64(last.duration) > durationToTicks(h.target())
+		if segmentFull || unit.Keyframe && segmentDuration >= h.config.SegmentDuration {
+			if err := h.finishSegment(); err != nil {
+				return err
+			}
+		} else if h.config.PartDuration > 0 && h.partFull(ticks) {
+			if err := h.finishPart(); err != nil {
+				return err
+			}
+			if err := h.writePlaylist(false); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(h.pending) == 0 && h.current.data.Len() == 0 {
+		h.current.start = ticks
+	}
+	h.pending = append(h.pending, mp4Sample{data: avccSample(unit.Nalus), pts: ticks, keyframe: unit.Keyframe})
+	return nil
+}
+
+// target returns the target duration of the playlist.
+func (h *HlsSink) target() time.Duration {
+	return time.Duration(h.targetDuration) * time.Second
+}
+
+// endLastSample sets the duration of the last pending sample. A picture lasting longer than the part or the
+// segment may, as on a static screen, ends with them, so that both stay within their targets.
+func (h *HlsSink) endLastSample(duration uint64) {
+	last := &h.pending[len(h.pending)-1]
+	end := h.current.start + durationToTicks(h.target())
+	if h.config.PartDuration > 0 {
+		if partEnd := h.pending[0].pts + durationToTicks(h.config.PartDuration); partEnd < end {
+			end = partEnd
+		}
+	}
+	if last.pts < end && last.pts+duration > end {
+		duration = end - last.pts
+	}
+	last.duration = uint32(duration)
+}
+
+// partFull reports whether the pending part has to be cut before the sample at ticks. The new sample is expected
+// to last as long as the previous one, the part is cut if it would not fit anymore.
+func (h *HlsSink) partFull(ticks uint64) bool {
+	last := h.pending[len(h.pending)-1]
+	if ticks < h.pending[0].pts {
+		return false
+	}
+	return ticksToDuration(ticks-h.pending[0].pts+uint64(last.duration)) > h.config.PartDuration
+}
+
+// finish writes the remaining samples as last segment and ends the playlist.
+func (h *HlsSink) finish() error {
+	if !h.started || len(h.pending) == 0 {
+		return nil
+	}
+	h.endLastSample(defaultSampleDuration)
+	if err := h.finishPart(); err != nil {
+		return err
+	}
+	return h.closeSegment(true)
+}
+
+// finishPart moves the pending samples into the current segment and writes them as part file if parts are enabled.
+func (h *HlsSink) finishPart() error {
+	h.sequence++
+	fragment := mp4Fragment(h.sequence, h.pending)
+	var duration time.Duration
+	for _, sample := range h.pending {
+		duration += ticksToDuration(uint64(sample.duration))
+	}
+	part := hlsPart{
+		name:        fmt.Sprintf("segment%d.%d.m4s", h.current.index, len(h.current.parts)),
+		duration:    duration,
+		independent: h.pending[0].keyframe,
+	}
+	h.pending = nil
+
+	h.current.data.Write(fragment)
+	h.current.duration += duration
+	if h.config.PartDuration > 0 {
+		if err := h.writeFile(part.name, fragment); err != nil {
+			return err
+		}
+		h.current.parts = append(h.current.parts, part)
+	}
+	return nil
+}
+
+func (h *HlsSink) finishSegment() error {
+	if err := h.finishPart(); err != nil {
+		return err
+	}
+	return h.closeSegment(false)
+}
+
+// closeSegment writes the current segment, updates the playlist and removes segments that fell out of it.
+func (h *HlsSink) closeSegment(end bool) error {
+	if err := h.writeFile(segmentName(h.current.index), h.current.data.Bytes()); err != nil {
+		return err
+	}
+	h.current.data = bytes.Buffer{}
+	h.segments = append(h.segments, h.current)
+	h.current = hlsSegment{index: h.current.index + 1}
+
+	for len(h.segments) > h.config.PlaylistSize {
+		h.segments = h.segments[1:]
+	}
+	if err := h.writePlaylist(end); err != nil {
+		return err
+	}
+	h.removeSegment(h.segments[0].index - hlsKeepExtraSegments - 1)
+	return nil
+}
+
+func (h *HlsSink) removeSegment(index int) {
+	if index < 0 {
+		return
+	}
+	names, _ := filepath.Glob(filepath.Join(h.dir, fmt.Sprintf("segment%d.*m4s", index)))
+	for _, name := range names {
+		if err := os.Remove(name); err != nil {
+			log.Debugf("Failed removing old hls segment: %s", err)
+		}
+	}
+}
+
+func (h *HlsSink) writePlaylist(end bool) error {
+	if len(h.segments) == 0 && len(h.current.parts) == 0 {
+		return nil
+	}
+	var playlist strings.Builder
+	playlist.WriteString("#EXTM3U\n")
+	if h.config.PartDuration > 0 {
+		playlist.WriteString("#EXT-X-VERSION:9\n")
+	} else {
+		playlist.WriteString("#EXT-X-VERSION:7\n")
+	}
+	fmt.Fprintf(&playlist, "#EXT-X-TARGETDURATION:%d\n", h.targetDuration)
+	if h.config.PartDuration > 0 {
+		part := h.config.PartDuration.Seconds()
+		fmt.Fprintf(&playlist, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", part)
+		fmt.Fprintf(&playlist, "#EXT-X-SERVER-CONTROL:PART-HOLD-BACK=%.3f\n", 3*part)
+	}
+	mediaSequence := h.current.index
+	if len(h.segments) > 0 {
+		mediaSequence = h.segments[0].index
+	}
+	fmt.Fprintf(&playlist, "#EXT-X-MEDIA-SEQUENCE:%d\n", mediaSequence)
+	fmt.Fprintf(&playlist, "#EXT-X-MAP:URI=\"%s\"\n", hlsInitName)
+
+	for i, segment := range h.segments {
+		if len(h.segments)-i <= hlsPartSegments {
+			writeParts(&playlist, segment.parts)
+		}
+		fmt.Fprintf(&playlist, "#EXTINF:%.3f,\n%s\n", segment.duration.Seconds(), segmentName(segment.index))
+	}
+	if end {
+		playlist.WriteString("#EXT-X-ENDLIST\n")
+	} else {
+		writeParts(&playlist, h.current.parts)
+	}
+	return h.writeFile(hlsPlaylistName, []byte(playlist.String()))
+}
+
+func writeParts(playlist *strings.Builder, parts []hlsPart) {
+	for _, part := range parts {
+		fmt.Fprintf(playlist, "#EXT-X-PART:DURATION=%.3f,URI=\"%s\"", part.duration.Seconds(), part.name)
+		if part.independent {
+			playlist.WriteString(",INDEPENDENT=YES")
+		}
+		playlist.WriteString("\n")
+	}
+}
+
+// writeFile replaces the file atomically, so that the http server never serves a half written one.
+func (h *HlsSink) writeFile(name string, data []byte) error {
+	tmp, err := ioutil.TempFile(h.dir, "."+name)
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	_ = os.Chmod(tmp.Name(), 0644)
+	return os.Rename(tmp.Name(), filepath.Join(h.dir, name))
+}
+
+func segmentName(index int) string {
+	return fmt.Sprintf("segment%d.m4s", index)
+}
+
+func ticksToDuration(ticks uint64) time.Duration {
+	return time.Duration(ticks) * time.Second / mp4Timescale
+}
+
+func durationToTicks(duration time.Duration) uint64 {
+	return uint64(duration/time.Microsecond) * mp4Timescale / 1000000
+}
+
+// avccSample prefixes every nalu with its length, as mp4 samples store them.
+func avccSample(nalus [][]byte) []byte {
+	size := 0
+	for _, nalu := range nalus {
+		size += 4 + len(nalu)
+	}
+	sample := make([]byte, 0, size)
+	for _, nalu := range nalus {
+		sample = append(sample, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(sample[len(sample)-4:], uint32(len(nalu)))
+		sample = append(sample, nalu...)
+	}
+	return sample
+}
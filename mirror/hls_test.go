@@ -0,0 +1,259 @@
+package mirror
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestHlsPlaylist(t *testing.T) {
+	tests := []struct {
+		name   string
+		config HlsConfig
+		// rate frames are sent per period, with a key frame every keyframeInterval frames
+		frames           int
+		rate             int
+		period           time.Duration
+		keyframeInterval int
+		want             string
+	}{
+		{
+			name:             "segments",
+			config:           HlsConfig{},
+			frames:           300,
+			rate:             60,
+			period:           time.Second,
+			keyframeInterval: 120,
+			want: `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:2.000,
+segment0.m4s
+#EXTINF:2.000,
+segment1.m4s
+#EXTINF:1.000,
+segment2.m4s
+#EXT-X-ENDLIST
+`,
+		},
+		{
+			name:             "segments are cut at the next key frame",
+			config:           HlsConfig{SegmentDuration: time.Second, PlaylistSize: 2},
+			frames:           450,
+			rate:             60,
+			period:           time.Second,
+			keyframeInterval: 90,
+			want: `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:2
+#EXT-X-MEDIA-SEQUENCE:3
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:1.500,
+segment3.m4s
+#EXTINF:1.500,
+segment4.m4s
+#EXT-X-ENDLIST
+`,
+		},
+		{
+			name:             "parts",
+			config:           HlsConfig{PartDuration: 500 * time.Millisecond},
+			frames:           180,
+			rate:             60,
+			period:           time.Second,
+			keyframeInterval: 120,
+			want: `#EXTM3U
+#EXT-X-VERSION:9
+#EXT-X-TARGETDURATION:4
+#EXT-X-PART-INF:PART-TARGET=0.500
+#EXT-X-SERVER-CONTROL:PART-HOLD-BACK=1.500
+#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-MAP:URI="init.mp4"
+#EXT-X-PART:DURATION=0.500,URI="segment0.0.m4s",INDEPENDENT=YES
+#EXT-X-PART:DURATION=0.500,URI="segment0.1.m4s"
+#EXT-X-PART:DURATION=0.500,URI="segment0.2.m4s"
+#EXT-X-PART:DURATION=0.500,URI="segment0.3.m4s"
+#EXTINF:2.000,
+segment0.m4s
+#EXT-X-PART:DURATION=0.500,URI="segment1.0.m4s",INDEPENDENT=YES
+#EXT-X-PART:DURATION=0.500,URI="segment1.1.m4s"
+#EXTINF:1.000,
+segment1.m4s
+#EXT-X-ENDLIST
+`,
+		},
+		{
+			name:             "a picture longer than the part target ends with the part",
+			config:           HlsConfig{PartDuration: 500 * time.Millisecond},
+			frames:           4,
+			rate:             5,
+			period:           4 * time.Second,
+			keyframeInterval: 10,
+			want: `#EXTM3U
+#EXT-X-VERSION:9
+#EXT-X-TARGETDURATION:4
+#EXT-X-PART-INF:PART-TARGET=0.500
+#EXT-X-SERVER-CONTROL:PART-HOLD-BACK=1.500
+#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-MAP:URI="init.mp4"
+#EXT-X-PART:DURATION=0.500,URI="segment0.0.m4s",INDEPENDENT=YES
+#EXT-X-PART:DURATION=0.500,URI="segment0.1.m4s"
+#EXT-X-PART:DURATION=0.500,URI="segment0.2.m4s"
+#EXT-X-PART:DURATION=0.017,URI="segment0.3.m4s"
+#EXTINF:1.517,
+segment0.m4s
+#EXT-X-ENDLIST
+`,
+		},
+		{
+			name:             "segments without key frames are cut at the target",
+			config:           HlsConfig{SegmentDuration: time.Second},
+			frames:           300,
+			rate:             60,
+			period:           time.Second,
+			keyframeInterval: 300,
+			want: `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:2
+#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:2.000,
+segment0.m4s
+#EXTINF:2.000,
+segment1.m4s
+#EXTINF:1.000,
+segment2.m4s
+#EXT-X-ENDLIST
+`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "hls")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			sink, err := NewHlsSink(dir, test.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < test.frames; i++ {
+				unit := AccessUnit{
+					Nalus:            [][]byte{{0x41, byte(i)}},
+					SPS:              []byte{0x67, 0x42, 0x00, 0x1f},
+					PPS:              []byte{0x68, 0xce},
+					Width:            1170,
+					Height:           2532,
+					Keyframe:         i%test.keyframeInterval == 0,
+					PresentationTime: 10*time.Second + time.Duration(i)*test.period/time.Duration(test.rate),
+				}
+				if unit.Keyframe {
+					unit.Nalus[0][0] = 0x65
+				}
+				// queued directly, SendVideo drops units while the writer is behind
+				sink.units <- unit
+			}
+			if err := sink.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			playlist, err := ioutil.ReadFile(filepath.Join(dir, hlsPlaylistName))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(playlist) != test.want {
+				t.Errorf("got playlist\n%s\nwant\n%s", playlist, test.want)
+			}
+			uris := regexp.MustCompile(`(?m)^segment\S*$|URI="([^"]*)"`).FindAllStringSubmatch(string(playlist), -1)
+			for _, uri := range uris {
+				name := uri[0]
+				if uri[1] != "" {
+					name = uri[1]
+				}
+				if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+					t.Errorf("listed file is missing: %s", err)
+				}
+			}
+		})
+	}
+}
+
+func TestHlsStartsAtKeyframe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sink, err := NewHlsSink(dir, HlsConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		unit AccessUnit
+	}{
+		{name: "delta frame", unit: AccessUnit{Nalus: [][]byte{{0x41}}, SPS: []byte{0x67, 0x42, 0x00, 0x1f}, PPS: []byte{0x68}}},
+		{name: "key frame without parameter sets", unit: AccessUnit{Nalus: [][]byte{{0x65}}, Keyframe: true}},
+	}
+	for _, test := range tests {
+		if err := sink.SendVideo(test.unit); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, hlsInitName)); !os.IsNotExist(err) {
+		t.Error("stream started without a key frame with parameter sets")
+	}
+	if _, err := os.Stat(filepath.Join(dir, hlsPlaylistName)); !os.IsNotExist(err) {
+		t.Error("playlist written without a stream")
+	}
+}
+
+func TestHlsSendVideoSkipsToKeyframeWhenBehind(t *testing.T) {
+	// no writer runs, the queue holds one unit
+	sink := &HlsSink{units: make(chan AccessUnit, 1)}
+	tests := []struct {
+		name string
+		// drain empties the queue before sending
+		drain    bool
+		keyframe bool
+		err      bool
+		queued   int
+	}{
+		{name: "key frame", keyframe: true, queued: 1},
+		{name: "full queue", err: true, queued: 1},
+		{name: "delta frame after a drop", drain: true},
+		{name: "key frame after a drop", keyframe: true, queued: 1},
+		{name: "delta frame", drain: true, queued: 1},
+	}
+	for _, test := range tests {
+		if test.drain {
+			<-sink.units
+		}
+		if err := sink.SendVideo(AccessUnit{Keyframe: test.keyframe}); (err != nil) != test.err {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+		if len(sink.units) != test.queued {
+			t.Errorf("%s: %d units queued, want %d", test.name, len(sink.units), test.queued)
+		}
+	}
+}
+
+func TestNewHlsSinkRejectsLongParts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if _, err := NewHlsSink(dir, HlsConfig{PartDuration: 2 * time.Second}); err == nil {
+		t.Error("parts as long as the default segments accepted")
+	}
+}
@@ -1,27 +1,33 @@
-package main
+package mirror
 
 import (
 	"bytes"
 	"encoding/binary"
 	cm "github.com/danielpaulus/quicktime_video_hack/screencapture/coremedia"
-	"go.nanomsg.org/mangos/v3"
 	"io"
-	// register transports
-	_ "go.nanomsg.org/mangos/v3/transport/all"
+	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
 var startCode = []byte{00, 00, 00, 01}
 
 //ZMQWriter writes nalus into a file using 0x00000001 as a separator (h264 ANNEX B) and raw pcm audio into a wav file
 type IOSImageReceiver struct {
-	socket mangos.Socket
 	buffer bytes.Buffer
 	fh     io.Writer
 	pw     *io.PipeWriter
+	audio  *wavWriter
+	mp4    *mp4Writer
+	video  *videoDispatcher
+	// pts hands the presentation time of every sample to the decoder, which decodes them in order
+	pts     chan sampleTime
+	metrics *deviceMetrics
+	status  *sessionStatus
 }
 
-func NewStreamReceiver(socket mangos.Socket, pw *io.PipeWriter) IOSImageReceiver {
-	return IOSImageReceiver{socket: socket, pw: pw}
+func NewStreamReceiver(pw *io.PipeWriter) IOSImageReceiver {
+	return IOSImageReceiver{pw: pw}
 }
 
 func NewFileReceiver(fh io.Writer) IOSImageReceiver {
@@ -36,9 +42,45 @@ func (self IOSImageReceiver) Consume(buf cm.CMSampleBuffer) error {
 	return self.consumeVideo(buf)
 }
 
-func (self IOSImageReceiver) Stop() {}
+//Stop finalizes the header of the wav file and writes the last mp4 fragment
+func (self IOSImageReceiver) Stop() {
+	if self.audio != nil {
+		if err := self.audio.finalize(); err != nil {
+			log.Errorf("Failed finalizing wav file: %s", err)
+		}
+	}
+	if self.mp4 != nil {
+		if err := self.mp4.close(); err != nil {
+			log.Errorf("Failed finishing mp4 file: %s", err)
+		}
+	}
+}
 
 func (self IOSImageReceiver) consumeVideo(buf cm.CMSampleBuffer) error {
+	if buf.HasFormatDescription {
+		self.status.setSize(int(buf.FormatDescription.VideoDimensionWidth), int(buf.FormatDescription.VideoDimensionHeight))
+	}
+	if buf.HasSampleData() {
+		self.status.received(time.Now())
+	}
+	if self.mp4 != nil {
+		if buf.HasFormatDescription {
+			self.mp4.setFormat(buf.FormatDescription)
+		}
+		if buf.HasSampleData() {
+			if err := self.mp4.writeSample(buf.SampleData, presentationTime(buf)); err != nil {
+				log.Errorf("Failed writing mp4 sample: %s", err)
+			}
+		}
+	}
+	if self.video != nil {
+		if buf.HasFormatDescription {
+			self.video.setFormat(buf.FormatDescription)
+		}
+		if buf.HasSampleData() {
+			self.video.send(buf)
+		}
+	}
 	if buf.HasFormatDescription {
 		err := self.writeNalu(buf.FormatDescription.PPS)
 		if err != nil {
@@ -52,6 +94,12 @@ func (self IOSImageReceiver) consumeVideo(buf cm.CMSampleBuffer) error {
 	if !buf.HasSampleData() {
 		return nil
 	}
+	if self.pts != nil {
+		pushSample(self.pts, sampleTime{
+			pts:      time.Duration(toTimescale(presentationTime(buf), uint64(time.Second))),
+			received: time.Now(),
+		})
+	}
 	return self.writeNalus(buf.SampleData)
 }
 
@@ -69,6 +117,7 @@ func (self IOSImageReceiver) writeNalus(bytes []byte) error {
 }
 
 func (self IOSImageReceiver) writeNalu(naluBytes []byte) error {
+	self.metrics.add(counterNalus, 1)
 	_, err := self.buffer.Write(startCode)
 	if err != nil {
 		return err
@@ -79,18 +128,29 @@ func (self IOSImageReceiver) writeNalu(naluBytes []byte) error {
 	}
 
 	////여기서 부터 frame 하나씩
-	if self.fh == nil {
-		_, _ = io.Copy(self.pw, newAlphaReader(self.buffer))
-
-	} else {
+	if self.fh != nil {
 		_, _ = self.fh.Write(self.buffer.Bytes())
+	} else if self.pw != nil {
+		_, _ = io.Copy(self.pw, newAlphaReader(self.buffer))
 	}
 	self.buffer.Reset()
 	return nil
 }
 
 func (self IOSImageReceiver) consumeAudio(buffer cm.CMSampleBuffer) error {
-	return nil
+	if self.audio == nil {
+		return nil
+	}
+	if buffer.HasFormatDescription {
+		err := self.audio.setFormat(buffer.FormatDescription.AudioStreamBasicDescription)
+		if err != nil {
+			return err
+		}
+	}
+	if !buffer.HasSampleData() {
+		return nil
+	}
+	return self.audio.write(buffer.SampleData)
 }
 
 type trickle struct {
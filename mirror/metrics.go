@@ -0,0 +1,226 @@
+package mirror
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stages of the pipeline whose latency is recorded.
+const (
+	// stageDecode lasts from a sample arriving over usb until its picture was decoded.
+	stageDecode = "decode"
+	// stageScale is the conversion of a decoded picture into a scaled RGBA frame.
+	stageScale = "scale"
+	// stageCompare is the FastCompare against the previously emitted frame.
+	stageCompare = "compare"
+	// stageEncode is the image encoding of a push sink.
+	stageEncode = "encode"
+	// stageSend lasts until all frame sinks took a frame, including their encoding.
+	stageSend = "send"
+)
+
+type metricCounter int
+
+const (
+	counterUsbBytes metricCounter = iota
+	counterUsbMessages
+	counterNalus
+	counterFramesDecoded
+	counterFramesSuppressed
+	counterFramesEmitted
+	counterSendErrors
+	counterCount
+)
+
+var counterInfos = [counterCount]struct{ name, help string }{
+	counterUsbBytes:         {"ios_mirror_usb_bytes_total", "Bytes read from the usb bulk endpoint."},
+	counterUsbMessages:      {"ios_mirror_usb_messages_total", "Messages read from the usb bulk endpoint."},
+	counterNalus:            {"ios_mirror_nalus_total", "H264 NALUs received from the device."},
+	counterFramesDecoded:    {"ios_mirror_frames_decoded_total", "Pictures decoded from the h264 stream."},
+	counterFramesSuppressed: {"ios_mirror_frames_suppressed_total", "Decoded frames dropped for not exceeding the change threshold."},
+	counterFramesEmitted:    {"ios_mirror_frames_emitted_total", "Decoded frames handed to the sinks."},
+	counterSendErrors:       {"ios_mirror_send_errors_total", "Frames and access units a sink failed to send."},
+}
+
+var (
+	latencyBuckets   = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+	imageSizeBuckets = []float64{4096, 16384, 65536, 131072, 262144, 524288, 1048576, 2097152, 4194304}
+)
+
+// Metrics collects counters and histograms of the mirroring pipeline per device and serves them in the
+// Prometheus text format. Share one Metrics between all sessions through Config.Metrics and PushConfig.Metrics.
+type Metrics struct {
+	mu      sync.Mutex
+	devices map[string]*deviceMetrics
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{devices: map[string]*deviceMetrics{}}
+}
+
+// device returns the metrics of the device, nil if m is nil, which makes recording a no-op.
+func (m *Metrics) device(udid string) *deviceMetrics {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	device, ok := m.devices[udid]
+	if !ok {
+		device = &deviceMetrics{imageSizes: map[string]*histogram{}, latencies: map[string]*histogram{}}
+		m.devices[udid] = device
+	}
+	return device
+}
+
+// ServeHTTP writes all metrics, for example on /metrics.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = m.write(w)
+}
+
+func (m *Metrics) write(w io.Writer) error {
+	m.mu.Lock()
+	udids := make([]string, 0, len(m.devices))
+	for udid := range m.devices {
+		udids = append(udids, udid)
+	}
+	devices := make([]*deviceMetrics, len(udids))
+	sort.Strings(udids)
+	for i, udid := range udids {
+		devices[i] = m.devices[udid]
+	}
+	m.mu.Unlock()
+
+	var b strings.Builder
+	for c := metricCounter(0); c < counterCount; c++ {
+		info := counterInfos[c]
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s counter\n", info.name, info.help, info.name)
+		for i, device := range devices {
+			fmt.Fprintf(&b, "%s{udid=\"%s\"} %d\n", info.name, escapeLabel(udids[i]), atomic.LoadUint64(&device.counters[c]))
+		}
+	}
+
+	const imageSizeName = "ios_mirror_image_bytes"
+	fmt.Fprintf(&b, "# HELP %s Size of the images encoded by push sinks.\n# TYPE %s histogram\n", imageSizeName, imageSizeName)
+	for i, device := range devices {
+		device.mu.Lock()
+		for _, format := range sortedKeys(device.imageSizes) {
+			device.imageSizes[format].write(&b, imageSizeName, fmt.Sprintf("udid=\"%s\",format=\"%s\"", escapeLabel(udids[i]), escapeLabel(format)))
+		}
+		device.mu.Unlock()
+	}
+
+	const latencyName = "ios_mirror_stage_latency_seconds"
+	fmt.Fprintf(&b, "# HELP %s Time spent in a stage of the pipeline.\n# TYPE %s histogram\n", latencyName, latencyName)
+	for i, device := range devices {
+		device.mu.Lock()
+		for _, stage := range sortedKeys(device.latencies) {
+			device.latencies[stage].write(&b, latencyName, fmt.Sprintf("udid=\"%s\",stage=\"%s\"", escapeLabel(udids[i]), stage))
+		}
+		device.mu.Unlock()
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// deviceMetrics holds the metrics of one device, all methods can be called on nil.
+type deviceMetrics struct {
+	counters [counterCount]uint64
+
+	mu         sync.Mutex
+	imageSizes map[string]*histogram
+	latencies  map[string]*histogram
+}
+
+func (d *deviceMetrics) add(counter metricCounter, n uint64) {
+	if d == nil {
+		return
+	}
+	atomic.AddUint64(&d.counters[counter], n)
+}
+
+func (d *deviceMetrics) observeLatency(stage string, latency time.Duration) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	h, ok := d.latencies[stage]
+	if !ok {
+		h = newHistogram(latencyBuckets)
+		d.latencies[stage] = h
+	}
+	h.observe(latency.Seconds())
+}
+
+func (d *deviceMetrics) observeImageSize(format string, size int) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	h, ok := d.imageSizes[format]
+	if !ok {
+		h = newHistogram(imageSizeBuckets)
+		d.imageSizes[format] = h
+	}
+	h.observe(float64(size))
+}
+
+type histogram struct {
+	bounds []float64
+	// counts holds the observations per bucket, not cumulated
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(value float64) {
+	h.sum += value
+	h.count++
+	for i, bound := range h.bounds {
+		if value <= bound {
+			h.counts[i]++
+			return
+		}
+	}
+}
+
+func (h *histogram) write(b *strings.Builder, name string, labels string) {
+	cumulative := uint64(0)
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(b, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, strconv.FormatFloat(bound, 'f', -1, 64), cumulative)
+	}
+	fmt.Fprintf(b, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(b, "%s_sum{%s} %s\n", name, labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(b, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+func sortedKeys(histograms map[string]*histogram) []string {
+	keys := make([]string, 0, len(histograms))
+	for key := range histograms {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
@@ -0,0 +1,118 @@
+package mirror
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//go:embed web/*.html
+var webFiles embed.FS
+
+var webTemplates = template.Must(template.ParseFS(webFiles, "web/*.html"))
+
+const mjpegBoundary = "frame"
+
+// MjpegServer serves the frames of every session it is a sink of as multipart/x-mixed-replace
+// stream on /mjpeg/<udid> and a page showing all of them on /.
+type MjpegServer struct {
+	streams *broadcaster
+}
+
+// StreamConfig contains the settings of the MjpegServer and WebSocketServer.
+type StreamConfig struct {
+	// SendLatestOnConnect sends the most recent frame of a device to new clients right away,
+	// instead of letting them wait until the screen changes.
+	SendLatestOnConnect bool
+}
+
+// NewMjpegServer creates a MjpegServer, register it with a http.Server and add Sink to the session configs.
+func NewMjpegServer(config StreamConfig) *MjpegServer {
+	return &MjpegServer{streams: newBroadcaster(config.SendLatestOnConnect)}
+}
+
+// Sink returns a FrameSink that publishes the frames of one session. Closing it ends the streams of its device.
+// Browsers only show jpeg and png images.
+func (m *MjpegServer) Sink(encoder ImageEncoder) FrameSink {
+	return &mjpegSink{streams: m.streams, encoder: encoder}
+}
+
+func (m *MjpegServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if udid := strings.TrimPrefix(r.URL.Path, "/mjpeg/"); udid != r.URL.Path {
+		m.serveStream(w, r, udid)
+		return
+	}
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := webTemplates.ExecuteTemplate(w, "index.html", m.streams.udids()); err != nil {
+		log.Errorf("Failed rendering index page: %s", err)
+	}
+}
+
+func (m *MjpegServer) serveStream(w http.ResponseWriter, r *http.Request, udid string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	sub := m.streams.subscribe(udid)
+	if sub == nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer sub.close()
+
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+mjpegBoundary)
+	w.Header().Set("Cache-Control", "no-cache")
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case data, ok := <-sub.messages:
+			if !ok {
+				return
+			}
+			// messages are complete parts including the boundary
+			if _, err := w.Write(data); err != nil {
+				log.Debugf("MJPEG client of '%s' gone: %s", udid, err)
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+type mjpegSink struct {
+	streams *broadcaster
+	encoder ImageEncoder
+	udid    string
+}
+
+func (m *mjpegSink) Send(frame Frame) error {
+	data, err := frame.encode(m.encoder)
+	if err != nil {
+		return err
+	}
+	part := new(bytes.Buffer)
+	fmt.Fprintf(part, "--%s\r\nContent-Type: %s\r\nContent-Length: %d\r\n\r\n", mjpegBoundary, m.encoder.ContentType(), len(data))
+	part.Write(data)
+	part.WriteString("\r\n")
+	m.udid = frame.Udid
+	m.streams.publish(frame.Udid, part.Bytes())
+	return nil
+}
+
+func (m *mjpegSink) Close() error {
+	if m.udid != "" {
+		m.streams.remove(m.udid)
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package mirror
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+
+	cm "github.com/danielpaulus/quicktime_video_hack/screencapture/coremedia"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// mp4Timescale is the 90kHz clock usual for video, all sample times are converted into it
+	mp4Timescale = 90000
+	// a fragment is written on every key frame or once it holds this much of the stream
+	maxFragmentDuration = mp4Timescale
+	// duration of the very last sample, which has no successor to calculate it from
+	defaultSampleDuration = mp4Timescale / 60
+
+	sampleFlagsKeyframe    = 0x02000000
+	sampleFlagsNonKeyframe = 0x01010000
+)
+
+// mp4Writer muxes the h264 samples of a device into a fragmented mp4 file. The init segment is written
+// once the first format description arrived, each fragment starts with a key frame and carries the
+// presentation timestamps of the CMSampleBuffers. When the format changes, for example as the device
+// rotates, the fragments of the new format follow a new init segment at its first key frame.
+type mp4Writer struct {
+	mu          sync.Mutex
+	w           io.Writer
+	sps         []byte
+	pps         []byte
+	width       uint32
+	height      uint32
+	initWritten bool
+	// formatChanged is set while the init segment of a new format has not been written yet
+	formatChanged bool
+	closed        bool
+	firstPts      uint64
+	sequence      uint32
+	pending       []mp4Sample
+}
+
+type mp4Sample struct {
+	data     []byte
+	pts      uint64
+	duration uint32
+	keyframe bool
+}
+
+func newMp4Writer(w io.Writer) *mp4Writer {
+	return &mp4Writer{w: w}
+}
+
+func (m *mp4Writer) setFormat(format cm.FormatDescriptor) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.initWritten && bytes.Equal(format.SPS, m.sps) && bytes.Equal(format.PPS, m.pps) {
+		return
+	}
+	if len(format.SPS) < 4 || len(format.PPS) == 0 {
+		log.Warn("Format description without parameter sets, can not record mp4")
+		return
+	}
+	if m.initWritten {
+		log.Info("Video format changed, the mp4 recording continues with a new init segment")
+		m.formatChanged = true
+	}
+	m.sps = append([]byte{}, format.SPS...)
+	m.pps = append([]byte{}, format.PPS...)
+	m.width = format.VideoDimensionWidth
+	m.height = format.VideoDimensionHeight
+}
+
+// writeSample takes the length prefixed nalus of a CMSampleBuffer as they are stored in mp4 files.
+func (m *mp4Writer) writeSample(data []byte, presentationTime cm.CMTime) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return errors.New("mp4 recording already closed")
+	}
+	keyframe := isKeyframe(data)
+	if !m.initWritten || m.formatChanged {
+		if m.sps == nil || !keyframe {
+			// the recording and every new format start with the first key frame after the format description
+			return nil
+		}
+		if !m.initWritten {
+			m.firstPts = toTimescale(presentationTime, mp4Timescale)
+		}
+	}
+
+	pts := toTimescale(presentationTime, mp4Timescale)
+	if pts < m.firstPts {
+		pts = m.firstPts
+	}
+	pts -= m.firstPts
+
+	if n := len(m.pending); n > 0 {
+		last := &m.pending[n-1]
+		last.duration = defaultSampleDuration
+		if pts > last.pts {
+			last.duration = uint32(pts - last.pts)
+		}
+		if keyframe || pts-m.pending[0].pts >= maxFragmentDuration {
+			if err := m.writeFragment(); err != nil {
+				return err
+			}
+		}
+	}
+	if !m.initWritten || m.formatChanged {
+		// the fragments of the previous format were written above, the timeline continues
+		if err := m.writeInit(); err != nil {
+			return err
+		}
+	}
+	m.pending = append(m.pending, mp4Sample{data: append([]byte{}, data...), pts: pts, keyframe: keyframe})
+	return nil
+}
+
+// close writes the remaining samples, the writer itself is owned by the caller.
+func (m *mp4Writer) close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	if len(m.pending) == 0 {
+		return nil
+	}
+	m.pending[len(m.pending)-1].duration = defaultSampleDuration
+	return m.writeFragment()
+}
+
+func (m *mp4Writer) writeInit() error {
+	if _, err := m.w.Write(mp4InitSegment(m.sps, m.pps, m.width, m.height)); err != nil {
+		return err
+	}
+	m.initWritten = true
+	m.formatChanged = false
+	return nil
+}
+
+func (m *mp4Writer) writeFragment() error {
+	samples := m.pending
+	m.pending = nil
+	m.sequence++
+	_, err := m.w.Write(mp4Fragment(m.sequence, samples))
+	return err
+}
+
+// mp4InitSegment returns the ftyp and moov boxes describing a single h264 track without samples,
+// the samples follow in fragments.
+func mp4InitSegment(sps []byte, pps []byte, width uint32, height uint32) []byte {
+	ftyp := mp4Box("ftyp", []byte("isom"), u32(0x200), []byte("isomiso2avc1iso6mp41"))
+
+	mvhd := mp4FullBox("mvhd", 0, 0,
+		u32(0), u32(0), u32(1000), u32(0),
+		u32(0x00010000), u16(0x0100), make([]byte, 10),
+		unityMatrix(), make([]byte, 24), u32(2))
+	tkhd := mp4FullBox("tkhd", 0, 3,
+		u32(0), u32(0), u32(1), u32(0), u32(0), make([]byte, 8),
+		u16(0), u16(0), u16(0), u16(0),
+		unityMatrix(), u32(width<<16), u32(height<<16))
+	mdhd := mp4FullBox("mdhd", 0, 0, u32(0), u32(0), u32(mp4Timescale), u32(0), u16(0x55c4), u16(0))
+	hdlr := mp4FullBox("hdlr", 0, 0, u32(0), []byte("vide"), make([]byte, 12), []byte("VideoHandler\x00"))
+	vmhd := mp4FullBox("vmhd", 0, 1, make([]byte, 8))
+	dinf := mp4Box("dinf", mp4FullBox("dref", 0, 0, u32(1), mp4FullBox("url ", 0, 1)))
+
+	avcC := mp4Box("avcC",
+		[]byte{1, sps[1], sps[2], sps[3], 0xff, 0xe1}, u16(uint16(len(sps))), sps,
+		[]byte{1}, u16(uint16(len(pps))), pps)
+	avc1 := mp4Box("avc1",
+		make([]byte, 6), u16(1), make([]byte, 16),
+		u16(uint16(width)), u16(uint16(height)),
+		u32(0x00480000), u32(0x00480000), u32(0), u16(1),
+		make([]byte, 32), u16(0x0018), u16(0xffff), avcC)
+	stbl := mp4Box("stbl",
+		mp4FullBox("stsd", 0, 0, u32(1), avc1),
+		mp4FullBox("stts", 0, 0, u32(0)),
+		mp4FullBox("stsc", 0, 0, u32(0)),
+		mp4FullBox("stsz", 0, 0, u32(0), u32(0)),
+		mp4FullBox("stco", 0, 0, u32(0)))
+
+	trak := mp4Box("trak", tkhd, mp4Box("mdia", mdhd, hdlr, mp4Box("minf", vmhd, dinf, stbl)))
+	mvex := mp4Box("mvex", mp4FullBox("trex", 0, 0, u32(1), u32(1), u32(0), u32(0), u32(0)))
+	moov := mp4Box("moov", mvhd, trak, mvex)
+	return append(ftyp, moov...)
+}
+
+// mp4Fragment returns the moof and mdat boxes of the samples, the first sample decides the fragment start time.
+func mp4Fragment(sequence uint32, samples []mp4Sample) []byte {
+	const trunFlags = 0x000001 | 0x000100 | 0x000200 | 0x000400
+	// moof header, mfhd, traf header, tfhd, tfdt, trun header, sample count and data offset
+	moofSize := 8 + 16 + 8 + 16 + 20 + 12 + 4 + 4 + 12*len(samples)
+
+	trun := [][]byte{u32(uint32(len(samples))), u32(uint32(moofSize + 8))}
+	mdatSize := 8
+	for _, sample := range samples {
+		flags := uint32(sampleFlagsNonKeyframe)
+		if sample.keyframe {
+			flags = sampleFlagsKeyframe
+		}
+		trun = append(trun, u32(sample.duration), u32(uint32(len(sample.data))), u32(flags))
+		mdatSize += len(sample.data)
+	}
+
+	moof := mp4Box("moof",
+		mp4FullBox("mfhd", 0, 0, u32(sequence)),
+		mp4Box("traf",
+			mp4FullBox("tfhd", 0, 0x020000, u32(1)),
+			mp4FullBox("tfdt", 1, 0, u64(samples[0].pts)),
+			mp4FullBox("trun", 0, trunFlags, trun...)))
+
+	buf := bytes.NewBuffer(moof)
+	buf.Write(u32(uint32(mdatSize)))
+	buf.WriteString("mdat")
+	for _, sample := range samples {
+		buf.Write(sample.data)
+	}
+	return buf.Bytes()
+}
+
+func mp4Box(boxType string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+	box := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(box, uint32(size))
+	copy(box[4:], boxType)
+	for _, p := range payload {
+		box = append(box, p...)
+	}
+	return box
+}
+
+func mp4FullBox(boxType string, version byte, flags uint32, payload ...[]byte) []byte {
+	header := u32(flags)
+	header[0] = version
+	return mp4Box(boxType, append([][]byte{header}, payload...)...)
+}
+
+func unityMatrix() []byte {
+	return bytes.Join([][]byte{
+		u32(0x00010000), u32(0), u32(0),
+		u32(0), u32(0x00010000), u32(0),
+		u32(0), u32(0), u32(0x40000000),
+	}, nil)
+}
+
+func u16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func u64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
@@ -0,0 +1,170 @@
+package mirror
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	cm "github.com/danielpaulus/quicktime_video_hack/screencapture/coremedia"
+)
+
+// boxTree lists the types of the boxes in data, children in parentheses, and fails on sizes not adding up.
+func boxTree(t *testing.T, data []byte, containers map[string]int) string {
+	var types []string
+	for len(data) > 0 {
+		if len(data) < 8 {
+			t.Fatalf("%d trailing bytes", len(data))
+		}
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			t.Fatalf("box %q has size %d with %d bytes left", data[4:8], size, len(data))
+		}
+		boxType := string(data[4:8])
+		if offset, ok := containers[boxType]; ok {
+			boxType += "(" + boxTree(t, data[8+offset:size], containers) + ")"
+		}
+		types = append(types, boxType)
+		data = data[size:]
+	}
+	return strings.Join(types, " ")
+}
+
+func TestMp4Box(t *testing.T) {
+	tests := []struct {
+		name string
+		box  []byte
+		want []byte
+	}{
+		{name: "empty", box: mp4Box("free"), want: []byte{0, 0, 0, 8, 'f', 'r', 'e', 'e'}},
+		{name: "payloads", box: mp4Box("mdat", []byte{1, 2}, u16(0x0304)), want: []byte{0, 0, 0, 12, 'm', 'd', 'a', 't', 1, 2, 3, 4}},
+		{name: "full box", box: mp4FullBox("tfdt", 1, 0x020001, u32(5)), want: []byte{0, 0, 0, 16, 't', 'f', 'd', 't', 1, 2, 0, 1, 0, 0, 0, 5}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if !bytes.Equal(test.box, test.want) {
+				t.Errorf("got %x, want %x", test.box, test.want)
+			}
+		})
+	}
+}
+
+func TestMp4InitSegment(t *testing.T) {
+	segment := mp4InitSegment([]byte{0x67, 0x64, 0x00, 0x28}, []byte{0x68, 0xee}, 1170, 2532)
+	// avc1 is a sample entry with 78 bytes of fields before its children, stsd has an entry count
+	containers := map[string]int{"moov": 0, "trak": 0, "mdia": 0, "minf": 0, "dinf": 0, "stbl": 0, "mvex": 0, "stsd": 8, "avc1": 78}
+	want := "ftyp moov(mvhd trak(tkhd mdia(mdhd hdlr minf(vmhd dinf(dref) stbl(stsd(avc1(avcC)) stts stsc stsz stco)))) mvex(trex))"
+	if got := boxTree(t, segment, containers); got != want {
+		t.Errorf("got boxes %s, want %s", got, want)
+	}
+	avcC := segment[bytes.Index(segment, []byte("avcC"))+4:]
+	if profile := avcC[1:4]; !bytes.Equal(profile, []byte{0x64, 0x00, 0x28}) {
+		t.Errorf("avcC profile %x", profile)
+	}
+}
+
+func TestMp4Fragment(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples []mp4Sample
+	}{
+		{name: "key frame", samples: []mp4Sample{{data: []byte{0, 0, 0, 1, 0x65}, pts: 3000, duration: 1500, keyframe: true}}},
+		{name: "samples", samples: []mp4Sample{
+			{data: []byte{0, 0, 0, 2, 0x65, 1}, pts: 0, duration: 1500, keyframe: true},
+			{data: []byte{0, 0, 0, 1, 0x41}, pts: 1500, duration: 1501},
+			{data: []byte{0, 0, 0, 3, 0x41, 2, 3}, pts: 3001, duration: 1499},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fragment := mp4Fragment(7, test.samples)
+			containers := map[string]int{"moof": 0, "traf": 0}
+			if got, want := boxTree(t, fragment, containers), "moof(mfhd traf(tfhd tfdt trun)) mdat"; got != want {
+				t.Fatalf("got boxes %s, want %s", got, want)
+			}
+			moofSize := binary.BigEndian.Uint32(fragment)
+			if sequence := binary.BigEndian.Uint32(fragment[20:]); sequence != 7 {
+				t.Errorf("sequence %d", sequence)
+			}
+			tfdt := fragment[bytes.Index(fragment, []byte("tfdt"))+4:]
+			if decodeTime := binary.BigEndian.Uint64(tfdt[4:]); decodeTime != test.samples[0].pts {
+				t.Errorf("decode time %d", decodeTime)
+			}
+
+			trun := fragment[bytes.Index(fragment, []byte("trun"))+4:]
+			if count := binary.BigEndian.Uint32(trun[4:]); count != uint32(len(test.samples)) {
+				t.Errorf("sample count %d", count)
+			}
+			// the data offset is relative to the start of the moof box and points behind the mdat header
+			dataOffset := binary.BigEndian.Uint32(trun[8:])
+			if dataOffset != moofSize+8 {
+				t.Errorf("data offset %d, want %d", dataOffset, moofSize+8)
+			}
+			data := fragment[dataOffset:]
+			for i, sample := range test.samples {
+				entry := trun[12+12*i:]
+				flags := uint32(sampleFlagsNonKeyframe)
+				if sample.keyframe {
+					flags = sampleFlagsKeyframe
+				}
+				if duration, size, sampleFlags := binary.BigEndian.Uint32(entry), binary.BigEndian.Uint32(entry[4:]), binary.BigEndian.Uint32(entry[8:]); duration != sample.duration || size != uint32(len(sample.data)) || sampleFlags != flags {
+					t.Errorf("sample %d has duration %d, size %d and flags %#x", i, duration, size, sampleFlags)
+				}
+				if !bytes.HasPrefix(data, sample.data) {
+					t.Errorf("sample %d data %x not at its offset", i, sample.data)
+				}
+				data = data[len(sample.data):]
+			}
+		})
+	}
+}
+
+func TestMp4WriterStartsNewInitSegmentOnFormatChange(t *testing.T) {
+	portrait := cm.FormatDescriptor{SPS: []byte{0x67, 0x64, 0x00, 0x28}, PPS: []byte{0x68, 0xee}, VideoDimensionWidth: 1170, VideoDimensionHeight: 2532}
+	landscape := cm.FormatDescriptor{SPS: []byte{0x67, 0x64, 0x00, 0x29}, PPS: []byte{0x68, 0xee}, VideoDimensionWidth: 2532, VideoDimensionHeight: 1170}
+	keyframe := []byte{0, 0, 0, 1, 0x65}
+	delta := []byte{0, 0, 0, 1, 0x41}
+
+	out := new(bytes.Buffer)
+	writer := newMp4Writer(out)
+	steps := []struct {
+		format *cm.FormatDescriptor
+		sample []byte
+	}{
+		{format: &portrait},
+		{sample: keyframe},
+		{sample: delta},
+		{format: &portrait},
+		{sample: delta},
+		{format: &landscape},
+		// samples of the new format are dropped up to its key frame
+		{sample: delta},
+		{sample: keyframe},
+		{sample: delta},
+	}
+	for i, step := range steps {
+		if step.format != nil {
+			writer.setFormat(*step.format)
+			continue
+		}
+		if err := writer.writeSample(step.sample, cm.CMTime{CMTimeValue: uint64(i) * 100, CMTimeScale: 6000}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := boxTree(t, out.Bytes(), nil), "ftyp moov moof mdat ftyp moov moof mdat"; got != want {
+		t.Fatalf("got boxes %s, want %s", got, want)
+	}
+	second := out.Bytes()[bytes.LastIndex(out.Bytes(), []byte("ftyp"))-4:]
+	if !bytes.HasPrefix(second, mp4InitSegment(landscape.SPS, landscape.PPS, 2532, 1170)) {
+		t.Error("the second init segment does not describe the new format")
+	}
+	tfdt := second[bytes.Index(second, []byte("tfdt"))+4:]
+	// the key frame of the new format was step 7, the recording started at step 1
+	if decodeTime := binary.BigEndian.Uint64(tfdt[4:]); decodeTime != 600*mp4Timescale/6000 {
+		t.Errorf("decode time %d does not continue the timeline", decodeTime)
+	}
+}
@@ -0,0 +1,56 @@
+package mirror
+
+import (
+	"encoding/binary"
+
+	cm "github.com/danielpaulus/quicktime_video_hack/screencapture/coremedia"
+)
+
+const (
+	naluTypeSlice    = 1
+	naluTypeIdrSlice = 5
+	naluTypeSps      = 7
+	// naluTypeFuA marks a fragment of a nalu in RTP packets
+	naluTypeFuA = 28
+)
+
+// forEachNalu calls fn for every nalu of the 4 byte length prefixed sample data of a CMSampleBuffer.
+func forEachNalu(sampleData []byte, fn func(nalu []byte)) {
+	slice := sampleData
+	for len(slice) >= 4 {
+		length := binary.BigEndian.Uint32(slice)
+		if uint64(length)+4 > uint64(len(slice)) {
+			return
+		}
+		fn(slice[4 : length+4])
+		slice = slice[length+4:]
+	}
+}
+
+// isKeyframe reports whether the sample data contains an IDR slice.
+func isKeyframe(sampleData []byte) bool {
+	keyframe := false
+	forEachNalu(sampleData, func(nalu []byte) {
+		if len(nalu) > 0 && nalu[0]&0x1f == naluTypeIdrSlice {
+			keyframe = true
+		}
+	})
+	return keyframe
+}
+
+// presentationTime returns the presentation timestamp of the first sample in the buffer.
+func presentationTime(buf cm.CMSampleBuffer) cm.CMTime {
+	if len(buf.SampleTimingInfoArray) > 0 {
+		return buf.SampleTimingInfoArray[0].PresentationTimeStamp
+	}
+	return buf.OutputPresentationTimestamp
+}
+
+// toTimescale converts the time into ticks of the given timescale without overflowing for large values.
+func toTimescale(time cm.CMTime, timescale uint64) uint64 {
+	if time.CMTimeScale == 0 {
+		return 0
+	}
+	scale := uint64(time.CMTimeScale)
+	return time.CMTimeValue/scale*timescale + time.CMTimeValue%scale*timescale/scale
+}
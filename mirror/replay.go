@@ -0,0 +1,81 @@
+package mirror
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"time"
+)
+
+// ReplayUdid is the udid frames of a replayed stream carry when Config.Udid is empty.
+const ReplayUdid = "replay"
+
+const maxNaluSize = 16 * 1024 * 1024
+
+// replayAnnexB copies the annex b stream from r to w nalu by nalu. When fps is positive it waits 1/fps
+// after every coded slice, which replays streams with one slice per picture, as iOS devices send them,
+// in about real time. It returns early without error when ctx is cancelled.
+func replayAnnexB(ctx context.Context, r io.Reader, w io.Writer, fps float64) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxNaluSize)
+	scanner.Split(splitNalus)
+
+	var interval time.Duration
+	if fps > 0 {
+		interval = time.Duration(float64(time.Second) / fps)
+	}
+	next := time.Now()
+
+	for scanner.Scan() {
+		nalu := scanner.Bytes()
+		if _, err := w.Write(nalu); err != nil {
+			return err
+		}
+		if interval == 0 || !isSlice(nalu) {
+			if ctx.Err() != nil {
+				return nil
+			}
+			continue
+		}
+		next = next.Add(interval)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Until(next)):
+		}
+	}
+	return scanner.Err()
+}
+
+// splitNalus is a bufio.SplitFunc returning one nalu including its leading start code per token.
+func splitNalus(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	// skip the start code of the current nalu and search the one of the next nalu
+	if len(data) > 3 {
+		if i := bytes.Index(data[3:], []byte{0, 0, 1}); i >= 0 {
+			end := i + 3
+			if data[end-1] == 0 {
+				// 4 byte start code
+				end--
+			}
+			return end, data[:end], nil
+		}
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// isSlice reports whether the nalu behind the start code contains a coded slice of a picture.
+func isSlice(nalu []byte) bool {
+	header := bytes.TrimLeft(nalu, "\x00")
+	if len(header) < 2 || header[0] != 1 {
+		return false
+	}
+	naluType := header[1] & 0x1f
+	return naluType == naluTypeSlice || naluType == naluTypeIdrSlice
+}
@@ -0,0 +1,140 @@
+package mirror
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+const (
+	rtpPayloadType = 96
+	rtpClockRate   = 90000
+	// keeps packets including the interleaved and ip headers below the usual ethernet mtu
+	rtpMaxPayload  = 1400
+	rtpHeaderSize  = 12
+	fuHeaderSize   = 2
+	rtpVersionBits = 0x80
+	rtpMarkerBit   = 0x80
+	// rtcpSenderReport is the packet type of RTCP sender reports
+	rtcpSenderReport = 200
+	// ntpEpochOffset is the number of seconds from the NTP epoch in 1900 to the unix epoch
+	ntpEpochOffset = 2208988800
+)
+
+// rtpPacketizer packs access units into RTP packets as described in RFC 6184 using single nal unit
+// packets and FU-A fragments (packetization-mode=1).
+type rtpPacketizer struct {
+	ssrc     uint32
+	sequence uint16
+	// timestampBase is added to all timestamps, RFC 3550 asks for a random start value
+	timestampBase uint32
+
+	// packets and octets count what was sent for the sender reports, octets without the RTP headers
+	packets uint32
+	octets  uint32
+	// lastTimestamp is the RTP timestamp of the latest unit, received at lastTime
+	lastTimestamp uint32
+	lastTime      time.Time
+}
+
+func newRtpPacketizer(ssrc uint32, sequence uint16, timestampBase uint32) *rtpPacketizer {
+	return &rtpPacketizer{ssrc: ssrc, sequence: sequence, timestampBase: timestampBase}
+}
+
+func (p *rtpPacketizer) timestamp(presentationTime time.Duration) uint32 {
+	ticks := uint64(presentationTime/time.Microsecond) * rtpClockRate / 1000000
+	return p.timestampBase + uint32(ticks)
+}
+
+// packetize returns the packets of the unit, the marker bit is set on the last one. The parameter sets are
+// sent in band in front of every key frame so that clients can join at any key frame.
+func (p *rtpPacketizer) packetize(unit AccessUnit) [][]byte {
+	nalus := unit.Nalus
+	if unit.Keyframe && !containsParameterSets(nalus) {
+		nalus = append([][]byte{unit.SPS, unit.PPS}, nalus...)
+	}
+	timestamp := p.timestamp(unit.PresentationTime)
+	p.lastTimestamp = timestamp
+	p.lastTime = unit.Time
+	if p.lastTime.IsZero() {
+		p.lastTime = time.Now()
+	}
+
+	var packets [][]byte
+	for i, nalu := range nalus {
+		last := i == len(nalus)-1
+		if len(nalu) <= rtpMaxPayload {
+			packet := p.header(timestamp, last, len(nalu))
+			packets = append(packets, append(packet, nalu...))
+			continue
+		}
+
+		indicator := nalu[0]&0xe0 | naluTypeFuA
+		naluType := nalu[0] & 0x1f
+		payload := nalu[1:]
+		for start := true; len(payload) > 0; start = false {
+			size := rtpMaxPayload - fuHeaderSize
+			if size > len(payload) {
+				size = len(payload)
+			}
+			end := size == len(payload)
+			fuHeader := naluType
+			if start {
+				fuHeader |= 0x80
+			}
+			if end {
+				fuHeader |= 0x40
+			}
+			packet := p.header(timestamp, last && end, fuHeaderSize+size)
+			packet = append(packet, indicator, fuHeader)
+			packets = append(packets, append(packet, payload[:size]...))
+			payload = payload[size:]
+		}
+	}
+	return packets
+}
+
+func (p *rtpPacketizer) header(timestamp uint32, marker bool, payloadSize int) []byte {
+	packet := make([]byte, rtpHeaderSize, rtpHeaderSize+payloadSize)
+	packet[0] = rtpVersionBits
+	packet[1] = rtpPayloadType
+	if marker {
+		packet[1] |= rtpMarkerBit
+	}
+	binary.BigEndian.PutUint16(packet[2:], p.sequence)
+	binary.BigEndian.PutUint32(packet[4:], timestamp)
+	binary.BigEndian.PutUint32(packet[8:], p.ssrc)
+	p.sequence++
+	p.packets++
+	p.octets += uint32(payloadSize)
+	return packet
+}
+
+// senderReport returns a RTCP sender report (RFC 3550 section 6.4.1) that maps the wall time now to the RTP
+// timestamps, extrapolated from the latest unit. It returns nil before the first unit was packetized.
+func (p *rtpPacketizer) senderReport(now time.Time) []byte {
+	if p.lastTime.IsZero() {
+		return nil
+	}
+	timestamp := p.lastTimestamp + uint32(int64(now.Sub(p.lastTime).Seconds()*rtpClockRate))
+	report := make([]byte, 28)
+	report[0] = rtpVersionBits
+	report[1] = rtcpSenderReport
+	// the length is counted in 32 bit words minus one
+	binary.BigEndian.PutUint16(report[2:], uint16(len(report)/4-1))
+	binary.BigEndian.PutUint32(report[4:], p.ssrc)
+	binary.BigEndian.PutUint32(report[8:], uint32(now.Unix()+ntpEpochOffset))
+	binary.BigEndian.PutUint32(report[12:], uint32(uint64(now.Nanosecond())<<32/uint64(time.Second)))
+	binary.BigEndian.PutUint32(report[16:], timestamp)
+	binary.BigEndian.PutUint32(report[20:], p.packets)
+	binary.BigEndian.PutUint32(report[24:], p.octets)
+	return report
+}
+
+func containsParameterSets(nalus [][]byte) bool {
+	for _, nalu := range nalus {
+		if nalu[0]&0x1f == naluTypeSps {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package mirror
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestPacketizeSplitsAtMaxPayload(t *testing.T) {
+	tests := []struct {
+		name     string
+		naluSize int
+		// payloads are the sizes of the RTP payloads, without the 12 byte header
+		payloads []int
+	}{
+		{name: "single nal unit", naluSize: 100, payloads: []int{100}},
+		{name: "exactly the max payload", naluSize: rtpMaxPayload, payloads: []int{rtpMaxPayload}},
+		// the nal header is not repeated, fragments carry the indicator and the fu header instead
+		{name: "one byte over", naluSize: rtpMaxPayload + 1, payloads: []int{rtpMaxPayload, fuHeaderSize + 2}},
+		{name: "two full fragments", naluSize: 1 + 2*(rtpMaxPayload-fuHeaderSize), payloads: []int{rtpMaxPayload, rtpMaxPayload}},
+		{name: "three fragments", naluSize: 1 + 2*(rtpMaxPayload-fuHeaderSize) + 5, payloads: []int{rtpMaxPayload, rtpMaxPayload, fuHeaderSize + 5}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nalu := make([]byte, test.naluSize)
+			nalu[0] = 0x61 // nri 3, non-IDR slice
+			for i := 1; i < len(nalu); i++ {
+				nalu[i] = byte(i)
+			}
+			packetizer := newRtpPacketizer(0x01020304, 65535, 0)
+			packets := packetizer.packetize(AccessUnit{Nalus: [][]byte{nalu}, PresentationTime: time.Second})
+
+			if len(packets) != len(test.payloads) {
+				t.Fatalf("got %d packets, want %d", len(packets), len(test.payloads))
+			}
+			var reassembled []byte
+			for i, packet := range packets {
+				if got := len(packet) - rtpHeaderSize; got != test.payloads[i] {
+					t.Errorf("packet %d has a payload of %d bytes, want %d", i, got, test.payloads[i])
+				}
+				if sequence := binary.BigEndian.Uint16(packet[2:]); sequence != uint16(65535+i) {
+					t.Errorf("packet %d has sequence %d", i, sequence)
+				}
+				if timestamp := binary.BigEndian.Uint32(packet[4:]); timestamp != rtpClockRate {
+					t.Errorf("packet %d has timestamp %d, want %d", i, timestamp, rtpClockRate)
+				}
+				if marker := packet[1]&rtpMarkerBit != 0; marker != (i == len(packets)-1) {
+					t.Errorf("packet %d has marker %v", i, marker)
+				}
+				payload := packet[rtpHeaderSize:]
+				if len(packets) == 1 {
+					reassembled = payload
+					continue
+				}
+				if payload[0] != 0x60|naluTypeFuA {
+					t.Errorf("packet %d has fu indicator %#x", i, payload[0])
+				}
+				fuHeader := byte(0x01)
+				if i == 0 {
+					fuHeader |= 0x80
+					reassembled = append(reassembled, nalu[0])
+				}
+				if i == len(packets)-1 {
+					fuHeader |= 0x40
+				}
+				if payload[1] != fuHeader {
+					t.Errorf("packet %d has fu header %#x, want %#x", i, payload[1], fuHeader)
+				}
+				reassembled = append(reassembled, payload[fuHeaderSize:]...)
+			}
+			if !bytes.Equal(reassembled, nalu) {
+				t.Error("the fragments do not add up to the nal unit")
+			}
+		})
+	}
+}
+
+func TestPacketizePrependsParameterSetsToKeyframes(t *testing.T) {
+	sps := []byte{0x67, 0x42, 0x00, 0x1f}
+	pps := []byte{0x68, 0xce}
+	idr := []byte{0x65, 0x88}
+	tests := []struct {
+		name  string
+		unit  AccessUnit
+		nalus [][]byte
+	}{
+		{name: "key frame", unit: AccessUnit{Keyframe: true, SPS: sps, PPS: pps, Nalus: [][]byte{idr}}, nalus: [][]byte{sps, pps, idr}},
+		{name: "key frame with parameter sets", unit: AccessUnit{Keyframe: true, SPS: sps, PPS: pps, Nalus: [][]byte{sps, pps, idr}}, nalus: [][]byte{sps, pps, idr}},
+		{name: "delta frame", unit: AccessUnit{SPS: sps, PPS: pps, Nalus: [][]byte{{0x41, 0x9a}}}, nalus: [][]byte{{0x41, 0x9a}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packets := newRtpPacketizer(1, 0, 0).packetize(test.unit)
+			if len(packets) != len(test.nalus) {
+				t.Fatalf("got %d packets, want %d", len(packets), len(test.nalus))
+			}
+			for i, packet := range packets {
+				if !bytes.Equal(packet[rtpHeaderSize:], test.nalus[i]) {
+					t.Errorf("packet %d carries %x, want %x", i, packet[rtpHeaderSize:], test.nalus[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSenderReport(t *testing.T) {
+	packetizer := newRtpPacketizer(0xcafe, 0, 1000)
+	received := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	if report := packetizer.senderReport(received); report != nil {
+		t.Fatal("a report before the first unit")
+	}
+	packetizer.packetize(AccessUnit{Nalus: [][]byte{{0x65, 1, 2}}, PresentationTime: time.Second, Time: received})
+
+	report := packetizer.senderReport(received.Add(500 * time.Millisecond))
+	if len(report) != 28 || report[0] != 0x80 || report[1] != rtcpSenderReport || binary.BigEndian.Uint16(report[2:]) != 6 {
+		t.Fatalf("malformed sender report header %x", report[:4])
+	}
+	if ssrc := binary.BigEndian.Uint32(report[4:]); ssrc != 0xcafe {
+		t.Errorf("ssrc %#x", ssrc)
+	}
+	if seconds := binary.BigEndian.Uint32(report[8:]); seconds != uint32(received.Unix()+ntpEpochOffset) {
+		t.Errorf("ntp seconds %d", seconds)
+	}
+	if fraction := binary.BigEndian.Uint32(report[12:]); fraction != 1<<31 {
+		t.Errorf("ntp fraction %#x, want half a second", fraction)
+	}
+	if timestamp := binary.BigEndian.Uint32(report[16:]); timestamp != 1000+rtpClockRate*3/2 {
+		t.Errorf("rtp timestamp %d", timestamp)
+	}
+	if packets, octets := binary.BigEndian.Uint32(report[20:]), binary.BigEndian.Uint32(report[24:]); packets != 1 || octets != 3 {
+		t.Errorf("counted %d packets and %d octets", packets, octets)
+	}
+}
@@ -0,0 +1,580 @@
+package mirror
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	rtspTrackControl = "trackID=0"
+	rtspWriteTimeout = 5 * time.Second
+	// rtspMaxGop limits the access units kept for clients joining between two key frames
+	rtspMaxGop = 256
+	// rtcpReportInterval is the time between two RTCP sender reports
+	rtcpReportInterval = 5 * time.Second
+	// rtpPortAttempts limits the tries to bind an even RTP port with the next port free for RTCP
+	rtpPortAttempts = 16
+)
+
+var rtspStatusText = map[int]string{
+	200: "OK",
+	400: "Bad Request",
+	404: "Not Found",
+	454: "Session Not Found",
+	455: "Method Not Valid in This State",
+	459: "Aggregate Operation Not Allowed",
+	461: "Unsupported Transport",
+	501: "Not Implemented",
+	503: "Service Unavailable",
+}
+
+// RtspServer serves the h264 stream of every session it is a video sink of on rtsp://<addr>/<udid>.
+// The stream is packetized as described in RFC 6184 and sent over UDP or interleaved on the RTSP
+// connection, whatever the client asks for. RTCP sender reports go to the next port or channel.
+type RtspServer struct {
+	mu      sync.Mutex
+	streams map[string]*rtspStream
+}
+
+type rtspStream struct {
+	mu  sync.Mutex
+	sps []byte
+	pps []byte
+	// gop holds the access units since the last key frame, so that new clients can start decoding right away
+	gop     []AccessUnit
+	clients map[*rtspClient]struct{}
+}
+
+// rtspClient receives the access units of a stream, units is closed when the stream ended.
+type rtspClient struct {
+	units        chan AccessUnit
+	waitKeyframe bool
+}
+
+// NewRtspServer creates a RtspServer, call ListenAndServe and add Sink to the session configs.
+func NewRtspServer() *RtspServer {
+	return &RtspServer{streams: map[string]*rtspStream{}}
+}
+
+// Sink returns a VideoSink that publishes the stream of one session. Closing it disconnects the clients of its device.
+func (r *RtspServer) Sink() VideoSink {
+	return &rtspSink{server: r}
+}
+
+// ListenAndServe accepts RTSP connections on the TCP address until the listener fails.
+func (r *RtspServer) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return r.Serve(listener)
+}
+
+// Serve accepts RTSP connections on the listener until it fails.
+func (r *RtspServer) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go newRtspConn(r, conn).serve()
+	}
+}
+
+func (r *RtspServer) stream(udid string) *rtspStream {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.streams[udid]
+}
+
+func (r *RtspServer) publish(unit AccessUnit) {
+	r.mu.Lock()
+	stream, ok := r.streams[unit.Udid]
+	if !ok {
+		stream = &rtspStream{clients: map[*rtspClient]struct{}{}}
+		r.streams[unit.Udid] = stream
+	}
+	r.mu.Unlock()
+	stream.publish(unit)
+}
+
+func (r *RtspServer) remove(udid string) {
+	r.mu.Lock()
+	stream, ok := r.streams[udid]
+	delete(r.streams, udid)
+	r.mu.Unlock()
+	if !ok {
+		return
+	}
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	for client := range stream.clients {
+		delete(stream.clients, client)
+		close(client.units)
+	}
+}
+
+func (s *rtspStream) publish(unit AccessUnit) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sps = unit.SPS
+	s.pps = unit.PPS
+	switch {
+	case unit.Keyframe:
+		s.gop = []AccessUnit{unit}
+	case len(s.gop) > 0 && len(s.gop) < rtspMaxGop:
+		s.gop = append(s.gop, unit)
+	default:
+		s.gop = nil
+	}
+	for client := range s.clients {
+		client.deliver(unit)
+	}
+}
+
+// subscribe replays the current group of pictures to the new client, without one it waits for the next key frame.
+func (s *rtspStream) subscribe() *rtspClient {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	client := &rtspClient{units: make(chan AccessUnit, rtspMaxGop+32), waitKeyframe: true}
+	for _, unit := range s.gop {
+		client.deliver(unit)
+	}
+	s.clients[client] = struct{}{}
+	return client
+}
+
+func (s *rtspStream) unsubscribe(client *rtspClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.clients[client]; ok {
+		delete(s.clients, client)
+		close(client.units)
+	}
+}
+
+func (s *rtspStream) parameterSets() ([]byte, []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sps, s.pps
+}
+
+// deliver drops units a slow client can not take and skips everything up to the next key frame,
+// as the following pictures can not be decoded without the dropped one.
+func (c *rtspClient) deliver(unit AccessUnit) {
+	if c.waitKeyframe {
+		if !unit.Keyframe {
+			return
+		}
+		c.waitKeyframe = false
+	}
+	select {
+	case c.units <- unit:
+	default:
+		c.waitKeyframe = true
+	}
+}
+
+type rtspSink struct {
+	server *RtspServer
+	udid   string
+}
+
+func (r *rtspSink) SendVideo(unit AccessUnit) error {
+	r.udid = unit.Udid
+	r.server.publish(unit)
+	return nil
+}
+
+func (r *rtspSink) Close() error {
+	if r.udid != "" {
+		r.server.remove(r.udid)
+	}
+	return nil
+}
+
+type rtspRequest struct {
+	method string
+	url    string
+	header textproto.MIMEHeader
+}
+
+// rtspConn handles the requests of one client connection, which carries at most one session.
+type rtspConn struct {
+	server  *RtspServer
+	conn    net.Conn
+	reader  *bufio.Reader
+	writeMu sync.Mutex
+
+	session   string
+	stream    *rtspStream
+	transport *rtpTransport
+	client    *rtspClient
+}
+
+// rtpTransport sends the RTP packets of a session either interleaved on the RTSP connection or over UDP.
+// RTCP uses the next channel or port.
+type rtpTransport struct {
+	conn    *rtspConn
+	channel byte
+	udp     *net.UDPConn
+	remote  *net.UDPAddr
+	// rtcp receives the reports of the client, which are ignored, and sends the sender reports
+	rtcp       *net.UDPConn
+	rtcpRemote *net.UDPAddr
+}
+
+func newRtspConn(server *RtspServer, conn net.Conn) *rtspConn {
+	return &rtspConn{server: server, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (c *rtspConn) serve() {
+	defer c.close()
+	for {
+		req, err := c.readRequest()
+		if err != nil {
+			if err != io.EOF {
+				log.Debugf("RTSP client %s gone: %s", c.conn.RemoteAddr(), err)
+			}
+			return
+		}
+		log.Debugf("RTSP %s %s from %s", req.method, req.url, c.conn.RemoteAddr())
+		if err = c.handle(req); err != nil {
+			log.Debugf("RTSP client %s closed: %s", c.conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+func (c *rtspConn) close() {
+	if c.client != nil {
+		c.stream.unsubscribe(c.client)
+	}
+	if c.transport != nil && c.transport.udp != nil {
+		_ = c.transport.udp.Close()
+		_ = c.transport.rtcp.Close()
+	}
+	_ = c.conn.Close()
+}
+
+func (c *rtspConn) readRequest() (*rtspRequest, error) {
+	for {
+		prefix, err := c.reader.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if prefix[0] != '$' {
+			break
+		}
+		// interleaved RTCP reports of the client are ignored
+		header := make([]byte, 4)
+		if _, err = io.ReadFull(c.reader, header); err != nil {
+			return nil, err
+		}
+		if _, err = c.reader.Discard(int(binary.BigEndian.Uint16(header[2:]))); err != nil {
+			return nil, err
+		}
+	}
+
+	reader := textproto.NewReader(c.reader)
+	line, err := reader.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "RTSP/") {
+		return nil, fmt.Errorf("malformed request line %q", line)
+	}
+	header, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	if length, _ := strconv.Atoi(header.Get("Content-Length")); length > 0 {
+		if _, err = c.reader.Discard(length); err != nil {
+			return nil, err
+		}
+	}
+	return &rtspRequest{method: parts[0], url: parts[1], header: header}, nil
+}
+
+// handle answers a single request, an error closes the connection.
+func (c *rtspConn) handle(req *rtspRequest) error {
+	switch req.method {
+	case "OPTIONS":
+		return c.respond(req, 200, []string{"Public: OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN, GET_PARAMETER"}, "")
+	case "DESCRIBE":
+		return c.describe(req)
+	case "SETUP":
+		return c.setup(req)
+	case "PLAY":
+		return c.play(req)
+	case "TEARDOWN":
+		_ = c.respond(req, 200, nil, "")
+		return errors.New("teardown")
+	case "GET_PARAMETER", "SET_PARAMETER":
+		// used as keep alive
+		return c.respond(req, 200, nil, "")
+	default:
+		return c.respond(req, 501, nil, "")
+	}
+}
+
+func (c *rtspConn) describe(req *rtspRequest) error {
+	stream := c.server.stream(rtspUdid(req.url))
+	if stream == nil {
+		return c.respond(req, 404, nil, "")
+	}
+	sps, pps := stream.parameterSets()
+	if len(sps) < 4 || len(pps) == 0 {
+		// no format description was received yet
+		return c.respond(req, 503, nil, "")
+	}
+
+	host, _, _ := net.SplitHostPort(c.conn.LocalAddr().String())
+	sdp := strings.Join([]string{
+		"v=0",
+		"o=- 0 0 IN IP4 " + host,
+		"s=" + rtspUdid(req.url),
+		"c=IN IP4 0.0.0.0",
+		"t=0 0",
+		fmt.Sprintf("m=video 0 RTP/AVP %d", rtpPayloadType),
+		fmt.Sprintf("a=rtpmap:%d H264/%d", rtpPayloadType, rtpClockRate),
+		fmt.Sprintf("a=fmtp:%d packetization-mode=1;profile-level-id=%s;sprop-parameter-sets=%s,%s",
+			rtpPayloadType, hex.EncodeToString(sps[1:4]),
+			base64.StdEncoding.EncodeToString(sps), base64.StdEncoding.EncodeToString(pps)),
+		"a=control:" + rtspTrackControl,
+		"",
+	}, "\r\n")
+	return c.respond(req, 200, []string{
+		"Content-Base: " + strings.TrimSuffix(req.url, "/") + "/",
+		"Content-Type: application/sdp",
+	}, sdp)
+}
+
+func (c *rtspConn) setup(req *rtspRequest) error {
+	if c.transport != nil {
+		// the stream has a single track
+		return c.respond(req, 459, nil, "")
+	}
+	stream := c.server.stream(rtspUdid(req.url))
+	if stream == nil {
+		return c.respond(req, 404, nil, "")
+	}
+
+	transport := &rtpTransport{conn: c}
+	requested := req.header.Get("Transport")
+	var reply string
+	if strings.Contains(requested, "RTP/AVP/TCP") {
+		first, _, ok := transportPorts(requested, "interleaved=")
+		if !ok {
+			first = 0
+		}
+		transport.channel = byte(first)
+		reply = fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", first, first+1)
+	} else if first, second, ok := transportPorts(requested, "client_port="); ok {
+		host, _, err := net.SplitHostPort(c.conn.RemoteAddr().String())
+		if err != nil {
+			return err
+		}
+		transport.remote = &net.UDPAddr{IP: net.ParseIP(host), Port: first}
+		transport.rtcpRemote = &net.UDPAddr{IP: net.ParseIP(host), Port: second}
+		if transport.udp, transport.rtcp, err = listenRtpPorts(); err != nil {
+			log.Errorf("Failed opening RTP sockets: %s", err)
+			return c.respond(req, 503, nil, "")
+		}
+		go discardRtcp(transport.rtcp)
+		serverPort := transport.udp.LocalAddr().(*net.UDPAddr).Port
+		reply = fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d;server_port=%d-%d", first, second, serverPort, serverPort+1)
+	} else {
+		return c.respond(req, 461, nil, "")
+	}
+
+	c.session = randomHex(8)
+	c.stream = stream
+	c.transport = transport
+	return c.respond(req, 200, []string{"Transport: " + reply}, "")
+}
+
+func (c *rtspConn) play(req *rtspRequest) error {
+	if c.transport == nil {
+		return c.respond(req, 455, nil, "")
+	}
+	if session := strings.Split(req.header.Get("Session"), ";")[0]; session != "" && session != c.session {
+		return c.respond(req, 454, nil, "")
+	}
+	if c.client != nil {
+		// already playing, a second PLAY just confirms it
+		return c.respond(req, 200, nil, "")
+	}
+	if err := c.respond(req, 200, []string{"Range: npt=0.000-"}, ""); err != nil {
+		return err
+	}
+	c.client = c.stream.subscribe()
+	go c.sendStream(c.client, c.transport)
+	return nil
+}
+
+func (c *rtspConn) sendStream(client *rtspClient, transport *rtpTransport) {
+	packetizer := newRtpPacketizer(randomUint32(), uint16(randomUint32()), randomUint32())
+	reports := time.NewTicker(rtcpReportInterval)
+	defer reports.Stop()
+	for {
+		select {
+		case unit, ok := <-client.units:
+			if !ok {
+				// the device stream ended, closing the connection lets the client know
+				_ = c.conn.Close()
+				return
+			}
+			for _, packet := range packetizer.packetize(unit) {
+				if err := transport.send(packet); err != nil {
+					log.Debugf("Failed sending RTP to %s: %s", c.conn.RemoteAddr(), err)
+					_ = c.conn.Close()
+					return
+				}
+			}
+		case now := <-reports.C:
+			if report := packetizer.senderReport(now); report != nil {
+				if err := transport.sendReport(report); err != nil {
+					log.Debugf("Failed sending RTCP to %s: %s", c.conn.RemoteAddr(), err)
+				}
+			}
+		}
+	}
+}
+
+func (c *rtspConn) respond(req *rtspRequest, status int, header []string, body string) error {
+	var response strings.Builder
+	fmt.Fprintf(&response, "RTSP/1.0 %d %s\r\n", status, rtspStatusText[status])
+	fmt.Fprintf(&response, "CSeq: %s\r\n", req.header.Get("CSeq"))
+	if c.session != "" {
+		fmt.Fprintf(&response, "Session: %s;timeout=60\r\n", c.session)
+	}
+	for _, line := range header {
+		response.WriteString(line + "\r\n")
+	}
+	if body != "" {
+		fmt.Fprintf(&response, "Content-Length: %d\r\n", len(body))
+	}
+	response.WriteString("\r\n" + body)
+	return c.write([]byte(response.String()))
+}
+
+func (c *rtspConn) write(data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(rtspWriteTimeout))
+	_, err := c.conn.Write(data)
+	return err
+}
+
+func (t *rtpTransport) send(packet []byte) error {
+	if t.udp != nil {
+		_, err := t.udp.WriteToUDP(packet, t.remote)
+		return err
+	}
+	return t.conn.write(interleavedFrame(t.channel, packet))
+}
+
+func (t *rtpTransport) sendReport(report []byte) error {
+	if t.rtcp != nil {
+		_, err := t.rtcp.WriteToUDP(report, t.rtcpRemote)
+		return err
+	}
+	return t.conn.write(interleavedFrame(t.channel+1, report))
+}
+
+func interleavedFrame(channel byte, packet []byte) []byte {
+	frame := make([]byte, 4, 4+len(packet))
+	frame[0] = '$'
+	frame[1] = channel
+	binary.BigEndian.PutUint16(frame[2:], uint16(len(packet)))
+	return append(frame, packet...)
+}
+
+// listenRtpPorts binds an even RTP port and the following one for RTCP, as RFC 3550 asks for.
+func listenRtpPorts() (*net.UDPConn, *net.UDPConn, error) {
+	for attempt := 0; attempt < rtpPortAttempts; attempt++ {
+		rtp, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		port := rtp.LocalAddr().(*net.UDPAddr).Port
+		if port%2 == 0 {
+			if rtcp, err := net.ListenUDP("udp", &net.UDPAddr{Port: port + 1}); err == nil {
+				return rtp, rtcp, nil
+			}
+		}
+		_ = rtp.Close()
+	}
+	return nil, nil, errors.New("no free pair of udp ports")
+}
+
+// discardRtcp reads the receiver reports of a client until the socket is closed, they are not evaluated.
+func discardRtcp(conn *net.UDPConn) {
+	buffer := make([]byte, 1500)
+	for {
+		if _, _, err := conn.ReadFromUDP(buffer); err != nil {
+			return
+		}
+	}
+}
+
+// rtspUdid returns the udid of a request url like rtsp://host:8554/<udid>/trackID=0
+func rtspUdid(rawURL string) string {
+	path := rawURL
+	if parsed, err := url.Parse(rawURL); err == nil {
+		path = parsed.Path
+	}
+	path = strings.TrimSuffix(strings.Trim(path, "/"), "/"+rtspTrackControl)
+	return path
+}
+
+// transportPorts parses a port or channel pair like client_port=5000-5001 from a Transport header.
+func transportPorts(transport string, key string) (int, int, bool) {
+	for _, param := range strings.Split(transport, ";") {
+		if !strings.HasPrefix(param, key) {
+			continue
+		}
+		pair := strings.SplitN(strings.TrimPrefix(param, key), "-", 2)
+		first, err := strconv.Atoi(pair[0])
+		if err != nil {
+			return 0, 0, false
+		}
+		second := first + 1
+		if len(pair) == 2 {
+			if second, err = strconv.Atoi(pair[1]); err != nil {
+				return 0, 0, false
+			}
+		}
+		return first, second, true
+	}
+	return 0, 0, false
+}
+
+func randomHex(size int) string {
+	data := make([]byte, size)
+	_, _ = rand.Read(data)
+	return hex.EncodeToString(data)
+}
+
+func randomUint32() uint32 {
+	data := make([]byte, 4)
+	_, _ = rand.Read(data)
+	return binary.BigEndian.Uint32(data)
+}
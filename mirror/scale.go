@@ -0,0 +1,157 @@
+package mirror
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/3d0c/gmf"
+)
+
+// ScaleAlgorithm names the swscale interpolation decoded pictures are resized with.
+type ScaleAlgorithm string
+
+const (
+	ScaleFastBilinear ScaleAlgorithm = "fast_bilinear"
+	ScaleBilinear     ScaleAlgorithm = "bilinear"
+	// ScaleBicubic is sharp and the default.
+	ScaleBicubic ScaleAlgorithm = "bicubic"
+	// ScalePoint picks the nearest pixel, it is the fastest and keeps hard edges.
+	ScalePoint ScaleAlgorithm = "point"
+	// ScaleArea averages the covered pixels, which suits strong reductions.
+	ScaleArea    ScaleAlgorithm = "area"
+	ScaleLanczos ScaleAlgorithm = "lanczos"
+	ScaleSpline  ScaleAlgorithm = "spline"
+)
+
+// ParseScaleAlgorithm returns the algorithm of the given name, as used by the -scaleAlgorithm flag.
+func ParseScaleAlgorithm(name string) (ScaleAlgorithm, error) {
+	switch algorithm := ScaleAlgorithm(name); algorithm {
+	case ScaleFastBilinear, ScaleBilinear, ScaleBicubic, ScalePoint, ScaleArea, ScaleLanczos, ScaleSpline:
+		return algorithm, nil
+	}
+	return "", fmt.Errorf("unknown scale algorithm '%s', use fast_bilinear, bilinear, bicubic, point, area, lanczos or spline", name)
+}
+
+func (a ScaleAlgorithm) swsFlags() int {
+	switch a {
+	case ScaleFastBilinear:
+		return gmf.SWS_FAST_BILINEAR
+	case ScaleBilinear:
+		return gmf.SWS_BILINEAR
+	case ScalePoint:
+		return gmf.SWS_POINT
+	case ScaleArea:
+		return gmf.SWS_AREA
+	case ScaleLanczos:
+		return gmf.SWS_LANCZOS
+	case ScaleSpline:
+		return gmf.SWS_SPLINE
+	}
+	return gmf.SWS_BICUBIC
+}
+
+// ParseCrop reads a crop rectangle given as "x,y,width,height" in device pixels, as used by the -crop flag.
+// An empty spec returns the empty rectangle, which disables cropping.
+func ParseCrop(spec string) (image.Rectangle, error) {
+	if spec == "" {
+		return image.Rectangle{}, nil
+	}
+	parts := strings.Split(spec, ",")
+	if len(parts) != 4 {
+		return image.Rectangle{}, fmt.Errorf("crop '%s' is not x,y,width,height", spec)
+	}
+	var values [4]int
+	for i, part := range parts {
+		value, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || value < 0 {
+			return image.Rectangle{}, fmt.Errorf("crop '%s' is not x,y,width,height", spec)
+		}
+		values[i] = value
+	}
+	if values[2] == 0 || values[3] == 0 {
+		return image.Rectangle{}, fmt.Errorf("crop '%s' is empty", spec)
+	}
+	return image.Rect(values[0], values[1], values[0]+values[2], values[1]+values[3]), nil
+}
+
+// ScaleConfig decides the size of the decoded frames beyond Config.ScreenRatio. The zero value only applies the
+// screen ratio.
+type ScaleConfig struct {
+	// Width and Height set a fixed frame size in pixels. If only one of them is set, the other one keeps the
+	// aspect ratio. They replace the screen ratio and the maximum size.
+	Width  int
+	Height int
+	// MaxWidth and MaxHeight shrink frames scaled by the screen ratio further, keeping the aspect ratio,
+	// until they fit. 0 leaves the side unbounded.
+	MaxWidth  int
+	MaxHeight int
+	// Crop is the part of the screen in device pixels that is kept, for example to remove the status bar.
+	// It is cut out of the decoded picture at even coordinates before scaling, the sizes above apply to the
+	// cropped part. The empty rectangle keeps the whole screen.
+	Crop image.Rectangle
+	// Algorithm is the interpolation used for scaling, empty uses ScaleBicubic.
+	Algorithm ScaleAlgorithm
+}
+
+// frameLayout is the result of ScaleConfig for one picture size. crop is cut out of the decoded picture, the empty
+// rectangle keeps it whole, and the result is scaled to width and height.
+type frameLayout struct {
+	width  int
+	height int
+	crop   image.Rectangle
+}
+
+// layout returns how a decoded picture of the given size becomes a frame.
+func (c ScaleConfig) layout(width int, height int, screenRatio float64) frameLayout {
+	source := image.Rect(0, 0, width, height)
+	crop := source
+	if !c.Crop.Empty() {
+		// a crop that does not fit the picture, for example after the device rotated, is cut to it. The chroma
+		// of the decoded yuv 4:2:0 pictures has half the resolution, so the crop starts and ends at even pixels.
+		if crop = evenRect(c.Crop.Intersect(source)); crop.Empty() {
+			crop = source
+		}
+	}
+	cropWidth, cropHeight := float64(crop.Dx()), float64(crop.Dy())
+
+	var targetWidth, targetHeight float64
+	switch {
+	case c.Width > 0 && c.Height > 0:
+		targetWidth, targetHeight = float64(c.Width), float64(c.Height)
+	case c.Width > 0:
+		targetWidth, targetHeight = float64(c.Width), cropHeight*float64(c.Width)/cropWidth
+	case c.Height > 0:
+		targetWidth, targetHeight = cropWidth*float64(c.Height)/cropHeight, float64(c.Height)
+	default:
+		targetWidth, targetHeight = cropWidth*screenRatio, cropHeight*screenRatio
+		factor := 1.0
+		if c.MaxWidth > 0 && targetWidth > float64(c.MaxWidth) {
+			factor = float64(c.MaxWidth) / targetWidth
+		}
+		if c.MaxHeight > 0 && targetHeight*factor > float64(c.MaxHeight) {
+			factor = float64(c.MaxHeight) / targetHeight
+		}
+		targetWidth, targetHeight = targetWidth*factor, targetHeight*factor
+	}
+
+	result := frameLayout{width: roundSide(targetWidth), height: roundSide(targetHeight)}
+	if crop != source {
+		result.crop = crop
+	}
+	return result
+}
+
+func roundSide(side float64) int {
+	if rounded := int(math.Round(side)); rounded > 0 {
+		return rounded
+	}
+	return 1
+}
+
+// evenRect rounds the corners of the rectangle down to even coordinates.
+func evenRect(rect image.Rectangle) image.Rectangle {
+	return image.Rect(rect.Min.X&^1, rect.Min.Y&^1, rect.Max.X&^1, rect.Max.Y&^1)
+}
@@ -0,0 +1,60 @@
+package mirror
+
+import (
+	"image"
+	"testing"
+)
+
+func TestLayoutScalesCroppedPart(t *testing.T) {
+	crop := image.Rect(0, 88, 1170, 2532)
+	tests := []struct {
+		name        string
+		config      ScaleConfig
+		screenRatio float64
+		want        frameLayout
+	}{
+		{
+			name:        "full size",
+			config:      ScaleConfig{Crop: crop},
+			screenRatio: 1,
+			want:        frameLayout{width: 1170, height: 2444, crop: crop},
+		},
+		{
+			name:        "half the screen ratio",
+			config:      ScaleConfig{Crop: crop},
+			screenRatio: 0.5,
+			want:        frameLayout{width: 585, height: 1222, crop: crop},
+		},
+		{
+			name:        "fixed width of the cropped part",
+			config:      ScaleConfig{Crop: crop, Width: 390},
+			screenRatio: 1,
+			want:        frameLayout{width: 390, height: 815, crop: crop},
+		},
+		{
+			name:        "odd crop",
+			config:      ScaleConfig{Crop: image.Rect(1, 89, 1169, 2531)},
+			screenRatio: 1,
+			want:        frameLayout{width: 1168, height: 2442, crop: image.Rect(0, 88, 1168, 2530)},
+		},
+		{
+			name:        "crop partly outside of the picture",
+			config:      ScaleConfig{Crop: image.Rect(1000, 0, 1400, 400)},
+			screenRatio: 0.5,
+			want:        frameLayout{width: 85, height: 200, crop: image.Rect(1000, 0, 1170, 400)},
+		},
+		{
+			name:        "crop outside of the picture",
+			config:      ScaleConfig{Crop: image.Rect(2000, 0, 2100, 100)},
+			screenRatio: 0.5,
+			want:        frameLayout{width: 585, height: 1266},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.config.layout(1170, 2532, test.screenRatio); got != test.want {
+				t.Errorf("layout = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,491 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"image"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/danielpaulus/quicktime_video_hack/screencapture"
+	log "github.com/sirupsen/logrus"
+)
+
+// Config contains the settings of a single mirroring Session.
+type Config struct {
+	// Udid of the device to mirror, the first device found is used when empty.
+	Udid string
+	// ScreenRatio is the factor decoded frames are scaled with, 0.5 halves width and height.
+	ScreenRatio float64
+	// Scale sets a fixed or maximum frame size, a crop rectangle and the scaling algorithm.
+	Scale ScaleConfig
+	// ChangeThreshold is the FastCompare score against the previously emitted frame a decoded frame has
+	// to exceed to be emitted. nil uses DefaultChangeThreshold, 0 emits every changed frame and a negative
+	// value every frame.
+	ChangeThreshold *int64
+	// File receives the raw h264 nalus in annex b format instead of decoding them into frames.
+	// The caller owns the writer and has to flush and close it after the session stopped.
+	File io.Writer
+	// Audio receives the device audio as wav file. The header is finalized when the session stopped,
+	// the caller owns the writer and has to close it afterwards.
+	Audio io.WriteSeeker
+	// Mp4 receives the video as fragmented mp4 using the presentation timestamps of the device.
+	// The caller owns the writer and has to flush and close it after the session stopped.
+	Mp4 io.Writer
+	// Replay is a recorded annex b stream, as written with File, that is decoded instead of
+	// the stream of a device. No device is needed and the session ends with the stream.
+	Replay io.Reader
+	// ReplayFps paces Replay at this many pictures per second, 0 replays as fast as possible.
+	ReplayFps float64
+	// UsbCapture records every usb message read from the device so it can be replayed with UsbReplay.
+	// The caller owns the writer and has to flush and close it after the session stopped.
+	UsbCapture io.Writer
+	// UsbReplay is a usb capture that is fed into the message processor instead of the messages of a
+	// device. No device is needed and the session ends with the capture.
+	UsbReplay io.Reader
+	// UsbReplayRealtime keeps the recorded time between the messages of UsbReplay.
+	UsbReplayRealtime bool
+	// Sinks receive every frame and are closed when the session ended. Frames only delivers
+	// frames if no sinks are configured.
+	Sinks []FrameSink
+	// KeepAlive resends the last frame to the sinks when no frame was sent for this long, so that consumers
+	// connecting while the screen is static get a frame. 0 disables it.
+	KeepAlive time.Duration
+	// SkipDecoding leaves out the decoder, so no frames are produced and Sinks only get closed when the session ended.
+	// File, Mp4, Audio and VideoSinks still receive the stream. It can not be combined with Replay.
+	SkipDecoding bool
+	// VideoSinks receive the h264 stream of the device without decoding it and are closed when the
+	// session ended. Replay streams are decoded directly and do not reach them.
+	VideoSinks []VideoSink
+	// Metrics records the counters and histograms of the session under the udid of the device, nil disables them.
+	Metrics *Metrics
+	// Status lists the session in the status api from its creation on, nil leaves it out.
+	Status *StatusServer
+}
+
+// Frame is a decoded screen image that differs enough from the previously emitted one.
+// The first frame of a session is always decoded from an IDR picture.
+type Frame struct {
+	// Udid of the device the frame was captured from.
+	Udid  string
+	Image *image.RGBA
+	// Score is the FastCompare result against the previous frame, 0 for the first frame.
+	Score int64
+	// Orientation is OrientationPortrait or OrientationLandscape, it changes together with the size of Image
+	// when the device rotates.
+	Orientation string
+	// PresentationTime is the presentation timestamp of the CMSampleBuffer the frame was decoded from,
+	// 0 for replayed annex b streams.
+	PresentationTime time.Duration
+	Time             time.Time
+	// KeepAlive is set on the last frame resent after Config.KeepAlive, delta frames send it as a whole then.
+	KeepAlive bool
+	// encoded holds the images the sinks encoded of this frame, nil lets every sink encode its own
+	encoded *encodedImages
+}
+
+// Orientations of a Frame, derived from the sides of the decoded picture.
+const (
+	OrientationPortrait  = "portrait"
+	OrientationLandscape = "landscape"
+)
+
+func orientationOf(width int, height int) string {
+	if width > height {
+		return OrientationLandscape
+	}
+	return OrientationPortrait
+}
+
+// Session mirrors the screen of one iOS device. Create it with NewSession, call Start once the
+// device should be streaming and Stop to release the device again.
+type Session struct {
+	config  Config
+	device  IosDevice
+	metrics *deviceMetrics
+	status  *sessionStatus
+
+	frames chan Frame
+	errs   chan error
+	done   chan struct{}
+	// ctx is cancelled to stop the session, the parts of the pipeline shut down with it
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	started bool
+	// activating is closed when the running Start finished activating the device, nil without one
+	activating chan struct{}
+	// abandoned is set once Stop released the sinks of a session that never started
+	abandoned bool
+}
+
+// NewSession creates a Session for the given config without touching any USB device yet.
+func NewSession(config Config) *Session {
+	if config.ScreenRatio <= 0 {
+		config.ScreenRatio = 1
+	}
+	if config.ChangeThreshold == nil {
+		threshold := int64(DefaultChangeThreshold)
+		config.ChangeThreshold = &threshold
+	}
+	s := &Session{
+		config: config,
+		status: &sessionStatus{state: StateActivating},
+		frames: make(chan Frame, 1),
+		errs:   make(chan error, 4),
+		done:   make(chan struct{}),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	if config.Status != nil {
+		config.Status.add(s)
+	}
+	return s
+}
+
+// Start looks up the device, enables the QuickTime config and starts streaming in the background.
+// It returns an error if the device could not be activated, in which case Start may be retried.
+// Sessions with Config.Replay start replaying right away without looking for a device.
+// The session is stopped when ctx is cancelled, which also ends an activation in progress.
+func (s *Session) Start(ctx context.Context) error {
+	s.mu.Lock()
+	switch {
+	case s.started:
+		s.mu.Unlock()
+		return errors.New("session already started")
+	case s.abandoned:
+		s.mu.Unlock()
+		return errors.New("session already stopped")
+	case s.activating != nil:
+		s.mu.Unlock()
+		return errors.New("session is being started")
+	}
+	activating := make(chan struct{})
+	s.activating = activating
+	s.mu.Unlock()
+
+	// the device is activated without holding the lock, so that Stop can cancel it
+	device, err := s.activate(ctx)
+	if err != nil {
+		s.startFailed(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.activating = nil
+	close(activating)
+	if err != nil {
+		return err
+	}
+	s.device = device
+	s.started = true
+	s.metrics = s.config.Metrics.device(s.device.SerialNumber)
+	s.status.setState(StateStreaming)
+
+	// a session stopped during the activation starts anyway, run releases the device right away
+	go s.run()
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.cancel()
+		case <-s.done:
+		}
+	}()
+	return nil
+}
+
+// activate returns the device to stream from, for real devices it enables their QuickTime config.
+// It gives up when ctx is cancelled or the session is stopped.
+func (s *Session) activate(ctx context.Context) (IosDevice, error) {
+	if s.config.Replay != nil || s.config.UsbReplay != nil {
+		if s.config.Replay != nil && (s.config.File != nil || s.config.SkipDecoding) {
+			return IosDevice{}, errors.New("a replayed stream can only be decoded")
+		}
+		return IosDevice{SerialNumber: s.udid(), QTConfigIndex: -1, UsbMuxConfigIndex: -1}, nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	s.status.setState(StateActivating)
+	device, err := FindIosDevice(s.config.Udid)
+	if err != nil {
+		return IosDevice{}, err
+	}
+	device, err = EnableQTConfig(ctx, device)
+	if err != nil {
+		return IosDevice{}, err
+	}
+	s.status.setDevice(device)
+	return device, nil
+}
+
+// Stop ends the stream, disables the QuickTime config and waits until all resources are released.
+// The device is released first, the sinks are closed last. The sinks of a session that never started
+// are closed right away, it can not be started anymore afterwards. A running activation is cancelled.
+func (s *Session) Stop() {
+	s.cancel()
+	s.mu.Lock()
+	activating := s.activating
+	s.mu.Unlock()
+	if activating != nil {
+		<-activating
+	}
+	s.mu.Lock()
+	started := s.started
+	abandon := !started && !s.abandoned
+	s.abandoned = s.abandoned || abandon
+	s.mu.Unlock()
+	if started {
+		<-s.done
+		return
+	}
+	if abandon {
+		s.closeSinks()
+		s.closeVideoSinks()
+	}
+	s.status.setState(StateStopped)
+}
+
+// startFailed marks the session as waiting for Start to be retried.
+func (s *Session) startFailed(err error) {
+	s.status.setState(StateReconnecting)
+	s.status.setError(err)
+}
+
+// Status returns what the session is doing right now.
+func (s *Session) Status() SessionStatus {
+	return s.status.snapshot(s.udid())
+}
+
+// udid returns the udid of the device the session is for, ReplayUdid for replays without Config.Udid.
+func (s *Session) udid() string {
+	if s.config.Udid == "" && (s.config.Replay != nil || s.config.UsbReplay != nil) {
+		return ReplayUdid
+	}
+	return s.config.Udid
+}
+
+// Device returns the device this session is streaming from, it is only valid after Start succeeded.
+func (s *Session) Device() IosDevice {
+	return s.device
+}
+
+// Frames delivers decoded frames and is closed once the session ended. It has to be drained while the
+// session runs as the decoder blocks until each frame was received, frames of a stopped session are dropped.
+func (s *Session) Frames() <-chan Frame {
+	return s.frames
+}
+
+// Errors reports failures of the running session and is closed once the session ended.
+func (s *Session) Errors() <-chan error {
+	return s.errs
+}
+
+// Done is closed once the session ended and all resources were released.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Session) run() {
+	var wg sync.WaitGroup
+	defer func() {
+		wg.Wait()
+		// the device is released and the decoder finished, so the sinks go last
+		s.closeSinks()
+		s.closeVideoSinks()
+		// a session that ended on its own releases its context as well
+		s.cancel()
+		s.status.setState(StateStopped)
+		close(s.frames)
+		close(s.errs)
+		close(s.done)
+	}()
+
+	var consumer IOSImageReceiver
+	pr, pw := io.Pipe()
+	if s.config.File != nil {
+		consumer = NewFileReceiver(s.config.File)
+	} else if s.config.SkipDecoding {
+		// the receiver only feeds the recordings and video sinks
+		consumer = IOSImageReceiver{}
+	} else {
+		consumer = NewStreamReceiver(pw)
+		consumer.pts = make(chan sampleTime, ptsQueueSize)
+		decoded := make(chan Frame, 1)
+		dec := newDecoder(pr, s.config.ScreenRatio, s.config.Scale, *s.config.ChangeThreshold, decoded)
+		dec.pts = consumer.pts
+		dec.metrics = s.metrics
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := dec.h264ToJpeg(s.ctx); err != nil {
+				s.reportErr(err)
+			}
+			// unblock the receiver in case the decoder gave up early
+			_ = pr.Close()
+			close(decoded)
+		}()
+		go func() {
+			defer wg.Done()
+			s.dispatch(decoded)
+		}()
+	}
+	consumer.metrics = s.metrics
+	consumer.status = s.status
+	if s.config.Audio != nil {
+		consumer.audio = newWavWriter(s.config.Audio)
+	}
+	if s.config.Mp4 != nil {
+		consumer.mp4 = newMp4Writer(s.config.Mp4)
+	}
+	if len(s.config.VideoSinks) > 0 {
+		consumer.video = newVideoDispatcher(s.device.SerialNumber, s.config.VideoSinks, s.sendFailed)
+	}
+
+	var err error
+	switch {
+	case s.config.Replay != nil:
+		err = replayAnnexB(s.ctx, s.config.Replay, pw, s.config.ReplayFps)
+	case s.config.UsbReplay != nil:
+		mp := s.messageProcessor(discardUsbWriter{}, consumer)
+		err = replayUsbCapture(s.ctx, s.config.UsbReplay, mp, s.config.UsbReplayRealtime)
+		consumer.Stop()
+	default:
+		err = s.readDevice(consumer)
+	}
+	_ = pw.Close()
+	if err != nil {
+		s.reportErr(err)
+	}
+}
+
+func (s *Session) readDevice(consumer IOSImageReceiver) error {
+	adapter := UsbAdapter{}
+	var receiver screencapture.UsbDataReceiver = s.messageProcessor(&adapter, consumer)
+	if s.config.UsbCapture != nil {
+		capture, err := newCapturingReceiver(receiver, s.config.UsbCapture)
+		if err != nil {
+			return err
+		}
+		receiver = capture
+	}
+
+	err := startReading(s.ctx, &adapter, s.device, receiver, s.metrics)
+	consumer.Stop()
+	log.Info("Closing device")
+	return err
+}
+
+func (s *Session) messageProcessor(usbWriter screencapture.UsbWriter, consumer IOSImageReceiver) *screencapture.MessageProcessor {
+	// the message processor signals protocol errors on this channel and expects someone to listen
+	mpStop := make(chan interface{})
+	go func() {
+		select {
+		case <-mpStop:
+			log.Warn("Message processor requested stop")
+			s.cancel()
+		case <-s.done:
+		}
+	}()
+
+	mp := screencapture.NewMessageProcessor(usbWriter, mpStop, consumer, false)
+	return &mp
+}
+
+func (s *Session) dispatch(decoded <-chan Frame) {
+	var keepAlive <-chan time.Time
+	if s.config.KeepAlive > 0 && len(s.config.Sinks) > 0 {
+		ticker := time.NewTicker(s.config.KeepAlive)
+		defer ticker.Stop()
+		keepAlive = ticker.C
+	}
+	var last *Frame
+	var lastSent time.Time
+
+	for {
+		select {
+		case frame, ok := <-decoded:
+			if !ok {
+				return
+			}
+			frame.Udid = s.device.SerialNumber
+			if s.config.Replay != nil {
+				// replayed annex b streams do not pass the receiver, which tracks the device format otherwise
+				s.status.setSize(frame.Image.Bounds().Dx(), frame.Image.Bounds().Dy())
+				s.status.received(frame.Time)
+			}
+			if len(s.config.Sinks) == 0 {
+				select {
+				case s.frames <- frame:
+				case <-s.ctx.Done():
+					// Frames is not drained anymore once the session is stopped
+				}
+				continue
+			}
+			s.send(frame)
+			last = &frame
+			lastSent = time.Now()
+		case now := <-keepAlive:
+			if last != nil && now.Sub(lastSent) >= s.config.KeepAlive {
+				log.Debugf("Resending last frame of '%s'", last.Udid)
+				frame := *last
+				frame.Time = now
+				frame.KeepAlive = true
+				s.send(frame)
+				lastSent = now
+			}
+		}
+	}
+}
+
+func (s *Session) send(frame Frame) {
+	start := time.Now()
+	frame.encoded = &encodedImages{}
+	for _, sink := range s.config.Sinks {
+		if err := sink.Send(frame); err != nil {
+			s.sendFailed(err)
+		}
+	}
+	s.metrics.observeLatency(stageSend, time.Since(start))
+}
+
+// sendFailed counts and reports an error of a frame or video sink.
+func (s *Session) sendFailed(err error) {
+	s.metrics.add(counterSendErrors, 1)
+	s.reportErr(err)
+}
+
+// closeSinks closes all sinks of the session, it is also used when Stop abandons a session that never started.
+func (s *Session) closeSinks() {
+	for _, sink := range s.config.Sinks {
+		if err := sink.Close(); err != nil {
+			log.Warnf("Failed closing sink: %s", err)
+		}
+	}
+}
+
+// closeVideoSinks closes all video sinks of the session, it is also used when Stop abandons a session that never started.
+func (s *Session) closeVideoSinks() {
+	for _, sink := range s.config.VideoSinks {
+		if err := sink.Close(); err != nil {
+			log.Warnf("Failed closing video sink: %s", err)
+		}
+	}
+}
+
+func (s *Session) reportErr(err error) {
+	s.status.setError(err)
+	select {
+	case s.errs <- err:
+	default:
+		log.Errorf("Dropped session error: %s", err)
+	}
+}
@@ -0,0 +1,255 @@
+package mirror
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.nanomsg.org/mangos/v3"
+	"go.nanomsg.org/mangos/v3/protocol/push"
+
+	// register transports
+	_ "go.nanomsg.org/mangos/v3/transport/all"
+)
+
+// FrameSink receives the frames of a session. Send is called from a single goroutine,
+// Close is called once after the last frame was sent.
+type FrameSink interface {
+	Send(frame Frame) error
+	Close() error
+}
+
+// PushConfig contains the settings of the push sinks.
+type PushConfig struct {
+	// Encoder encodes the frames of a PushSink.
+	Encoder ImageEncoder
+	// Tiles makes a PushSink send keyframe and delta messages as described by TileConfig.
+	// The session should emit every changed frame then, see Config.ChangeThreshold.
+	Tiles *TileConfig
+	// Raw sends the bare payload without the envelope described by FrameHeader, for consumers
+	// written before the envelope existed.
+	Raw bool
+	// Metrics records the size and encoding time of the images, nil disables it.
+	Metrics *Metrics
+}
+
+// PushSink sends every frame encoded by its ImageEncoder to a mangos push socket.
+type PushSink struct {
+	socket mangos.Socket
+	config PushConfig
+	// mu guards the fields below, sinks sending delta frames also send keyframes from their own goroutine
+	mu       sync.Mutex
+	sequence uint64
+	// tiles is set for sinks sending delta frames
+	tiles *tileEncoder
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// NewPushSink dials the given push spec, for example tcp://127.0.0.1:7879
+func NewPushSink(pushSpec string, config PushConfig) (*PushSink, error) {
+	socket, err := dialPush(pushSpec)
+	if err != nil {
+		return nil, err
+	}
+	sink := &PushSink{socket: socket, config: config}
+	if config.Tiles != nil {
+		sink.tiles = newTileEncoder(*config.Tiles, config.Encoder)
+		sink.stop = make(chan struct{})
+		sink.done = make(chan struct{})
+		go sink.sendKeyframes()
+	}
+	return sink, nil
+}
+
+// Send encodes the frame and pushes it to the socket
+func (p *PushSink) Send(frame Frame) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var data []byte
+	var err error
+	format := string(p.config.Encoder.format())
+	start := time.Now()
+	if p.tiles != nil {
+		format = EnvelopeFormatTiles
+		data, err = p.tiles.encode(frame)
+	} else {
+		data, err = frame.encode(p.config.Encoder)
+	}
+	if err != nil || data == nil {
+		return err
+	}
+	return p.push(frame, format, data, start)
+}
+
+// push sends the encoded frame, wrapped in an envelope unless the sink is raw. It is called with mu held.
+func (p *PushSink) push(frame Frame, format string, data []byte, start time.Time) error {
+	metrics := p.config.Metrics.device(frame.Udid)
+	metrics.observeLatency(stageEncode, time.Since(start))
+	metrics.observeImageSize(format, len(data))
+	if !p.config.Raw {
+		p.sequence++
+		header := frameHeader(frame, p.sequence, format, p.config.Encoder.ContentType())
+		header.Keyframe = p.tiles != nil && data[0] == TileMessageKeyframe
+		var err error
+		if data, err = envelope(header, data); err != nil {
+			return err
+		}
+	}
+	return p.socket.Send(data)
+}
+
+// sendKeyframes sends the latest frame as keyframe whenever TileConfig.KeyframeInterval passed without one,
+// as a static screen produces no frames that would trigger it.
+func (p *PushSink) sendKeyframes() {
+	defer close(p.done)
+	interval := p.tiles.config.KeyframeInterval
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case now := <-timer.C:
+			p.mu.Lock()
+			next := p.tiles.nextKeyframe()
+			if next.IsZero() {
+				next = now.Add(interval)
+			} else if !now.Before(next) {
+				frame := p.tiles.last
+				frame.Time = now
+				start := time.Now()
+				data, err := p.tiles.keyframe(now)
+				if err == nil {
+					err = p.push(frame, EnvelopeFormatTiles, data, start)
+				}
+				if err != nil {
+					log.Warnf("Failed sending keyframe of '%s': %s", frame.Udid, err)
+				}
+				next = now.Add(interval)
+			}
+			p.mu.Unlock()
+			timer.Reset(next.Sub(now))
+		}
+	}
+}
+
+// Close closes the underlying socket
+func (p *PushSink) Close() error {
+	if p.stop != nil {
+		close(p.stop)
+		<-p.done
+	}
+	return p.socket.Close()
+}
+
+// H264PushSink is a VideoSink that pushes every access unit in annex b format to a mangos push socket,
+// key frames are preceded by SPS and PPS so that consumers can start decoding at any of them.
+// Nothing is decoded, which leaves the decoding to the consumer.
+type H264PushSink struct {
+	socket   mangos.Socket
+	config   PushConfig
+	sequence uint64
+	units    chan AccessUnit
+	done     chan struct{}
+	// waitKeyframe is set after units were dropped, only used by SendVideo
+	waitKeyframe bool
+}
+
+// NewH264PushSink dials the given push spec, for example tcp://127.0.0.1:7879. Only PushConfig.Raw applies.
+func NewH264PushSink(pushSpec string, config PushConfig) (*H264PushSink, error) {
+	socket, err := dialPush(pushSpec)
+	if err != nil {
+		return nil, err
+	}
+	sink := &H264PushSink{socket: socket, config: config, units: make(chan AccessUnit, 64), done: make(chan struct{})}
+	go sink.send()
+	return sink, nil
+}
+
+// SendVideo queues the access unit. If the consumer does not keep up, units are dropped up to the next key frame.
+func (h *H264PushSink) SendVideo(unit AccessUnit) error {
+	if h.waitKeyframe {
+		if !unit.Keyframe {
+			return nil
+		}
+		h.waitKeyframe = false
+	}
+	select {
+	case h.units <- unit:
+		return nil
+	default:
+		h.waitKeyframe = true
+		return errors.New("h264 push consumer too slow, skipping to the next key frame")
+	}
+}
+
+// Close sends the queued access units and closes the socket.
+func (h *H264PushSink) Close() error {
+	close(h.units)
+	<-h.done
+	return h.socket.Close()
+}
+
+func (h *H264PushSink) send() {
+	defer close(h.done)
+	for unit := range h.units {
+		data := annexB(unit)
+		if !h.config.Raw {
+			h.sequence++
+			var err error
+			data, err = envelope(FrameHeader{
+				Version:          EnvelopeVersion,
+				Udid:             unit.Udid,
+				Sequence:         h.sequence,
+				PresentationTime: int64(unit.PresentationTime / time.Microsecond),
+				Timestamp:        unit.Time.UnixNano() / int64(time.Millisecond),
+				Width:            unit.Width,
+				Height:           unit.Height,
+				Orientation:      orientationOf(unit.Width, unit.Height),
+				Format:           EnvelopeFormatH264,
+				ContentType:      "video/h264",
+				Keyframe:         unit.Keyframe,
+			}, data)
+			if err != nil {
+				log.Warnf("Failed encoding h264 envelope of '%s': %s", unit.Udid, err)
+				continue
+			}
+		}
+		if err := h.socket.Send(data); err != nil {
+			log.Warnf("Failed pushing h264 of '%s': %s", unit.Udid, err)
+		}
+	}
+}
+
+// annexB joins the nalus of the unit with start codes and prepends the parameter sets to key frames.
+func annexB(unit AccessUnit) []byte {
+	nalus := unit.Nalus
+	if unit.Keyframe && !containsParameterSets(nalus) {
+		nalus = append([][]byte{unit.SPS, unit.PPS}, nalus...)
+	}
+	size := 0
+	for _, nalu := range nalus {
+		size += len(startCode) + len(nalu)
+	}
+	data := make([]byte, 0, size)
+	for _, nalu := range nalus {
+		data = append(data, startCode...)
+		data = append(data, nalu...)
+	}
+	return data
+}
+
+func dialPush(pushSpec string) (mangos.Socket, error) {
+	socket, err := push.NewSocket()
+	if err != nil {
+		return nil, fmt.Errorf("socket new error: %w", err)
+	}
+	if err = socket.Dial(pushSpec); err != nil {
+		_ = socket.Close()
+		return nil, fmt.Errorf("dial %s: %w", pushSpec, err)
+	}
+	return socket, nil
+}
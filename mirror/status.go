@@ -0,0 +1,233 @@
+package mirror
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SessionState is the lifecycle state of a Session as reported by the status api.
+type SessionState string
+
+const (
+	// StateActivating is the state of a session that looks for its device and enables the QuickTime config.
+	StateActivating SessionState = "activating"
+	// StateStreaming is the state of a started session until it ended.
+	StateStreaming SessionState = "streaming"
+	// StateReconnecting is the state after Start failed, until Start is retried.
+	StateReconnecting SessionState = "reconnecting"
+	// StateStopped is the state of a session that ended or was stopped before it started.
+	StateStopped SessionState = "stopped"
+)
+
+// SessionStatus is a snapshot of what a session is doing.
+type SessionStatus struct {
+	Udid  string       `json:"udid"`
+	State SessionState `json:"state"`
+	// LastFrame is when the last video sample arrived, nil before the first one.
+	LastFrame *time.Time `json:"lastFrame,omitempty"`
+	// Width and Height are the video dimensions of the device, for replayed annex b streams the ones of the frames.
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+	Orientation string `json:"orientation,omitempty"`
+	LastError   string `json:"lastError,omitempty"`
+}
+
+// sessionStatus is updated by a session and the parts of its pipeline, all methods can be called on nil.
+type sessionStatus struct {
+	mu sync.Mutex
+	// device is set once the session found its device
+	device    *IosDevice
+	state     SessionState
+	lastFrame time.Time
+	width     int
+	height    int
+	lastError string
+}
+
+func (s *sessionStatus) setState(state SessionState) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = state
+}
+
+func (s *sessionStatus) setDevice(device IosDevice) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.device = &device
+}
+
+func (s *sessionStatus) foundDevice() (IosDevice, bool) {
+	if s == nil {
+		return IosDevice{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.device == nil {
+		return IosDevice{}, false
+	}
+	return *s.device, true
+}
+
+func (s *sessionStatus) setError(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastError = err.Error()
+}
+
+func (s *sessionStatus) setSize(width int, height int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.width = width
+	s.height = height
+}
+
+func (s *sessionStatus) received(now time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastFrame = now
+}
+
+func (s *sessionStatus) snapshot(udid string) SessionStatus {
+	if s == nil {
+		return SessionStatus{Udid: udid}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.device != nil {
+		udid = s.device.SerialNumber
+	}
+	status := SessionStatus{Udid: udid, State: s.state, Width: s.width, Height: s.height, LastError: s.lastError}
+	if !s.lastFrame.IsZero() {
+		lastFrame := s.lastFrame
+		status.LastFrame = &lastFrame
+	}
+	if s.width > 0 && s.height > 0 {
+		status.Orientation = orientationOf(s.width, s.height)
+	}
+	return status
+}
+
+// StatusServer serves the devices and sessions of a process as JSON. Sessions are listed once they were created
+// with Config.Status, a new session of the same udid replaces the previous one. Devices are listed once a session
+// found them or a Supervisor with SupervisorConfig.Status saw them attached, also if it skipped them.
+//
+// GET / returns {"devices": [...], "sessions": [...]} with the IosDevice.DetailsMap of every device,
+// GET /<udid> returns the SessionStatus of one session.
+type StatusServer struct {
+	mu       sync.Mutex
+	sessions []*Session
+	// attached holds the devices a supervisor saw until they were detached
+	attached map[string]IosDevice
+}
+
+func NewStatusServer() *StatusServer {
+	return &StatusServer{}
+}
+
+func (s *StatusServer) add(session *Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessions := s.sessions[:0]
+	for _, known := range s.sessions {
+		if session.config.Udid == "" || known.config.Udid != session.config.Udid {
+			sessions = append(sessions, known)
+		}
+	}
+	s.sessions = append(sessions, session)
+}
+
+// attach lists the device until detach is called for it, it can be called on nil.
+func (s *StatusServer) attach(device IosDevice) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attached == nil {
+		s.attached = map[string]IosDevice{}
+	}
+	s.attached[device.SerialNumber] = device
+}
+
+func (s *StatusServer) detach(udid string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.attached, udid)
+}
+
+func (s *StatusServer) list() ([]*Session, []IosDevice) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	devices := make([]IosDevice, 0, len(s.attached))
+	for _, device := range s.attached {
+		devices = append(devices, device)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].SerialNumber < devices[j].SerialNumber })
+	return append([]*Session{}, s.sessions...), devices
+}
+
+func (s *StatusServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	udid := strings.Trim(r.URL.Path, "/")
+
+	sessions, attached := s.list()
+	devices := []map[string]interface{}{}
+	statuses := []SessionStatus{}
+	seen := map[string]bool{}
+	for _, session := range sessions {
+		status := session.Status()
+		if udid != "" {
+			if status.Udid == udid {
+				writeJSON(w, status)
+				return
+			}
+			continue
+		}
+		statuses = append(statuses, status)
+		if device, ok := session.status.foundDevice(); ok && !seen[device.SerialNumber] {
+			seen[device.SerialNumber] = true
+			devices = append(devices, device.DetailsMap())
+		}
+	}
+	if udid != "" {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+	for _, device := range attached {
+		if !seen[device.SerialNumber] {
+			seen[device.SerialNumber] = true
+			devices = append(devices, device.DetailsMap())
+		}
+	}
+	writeJSON(w, map[string]interface{}{"devices": devices, "sessions": statuses})
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(value)
+}
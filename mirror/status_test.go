@@ -0,0 +1,84 @@
+package mirror
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatusServerListsAttachedDevicesAndReplays(t *testing.T) {
+	server := NewStatusServer()
+	server.attach(IosDevice{SerialNumber: "00008030", QTConfigIndex: -1})
+	server.attach(IosDevice{SerialNumber: "00008101", QTConfigIndex: -1})
+	server.attach(IosDevice{SerialNumber: "00008110", QTConfigIndex: -1})
+	server.detach("00008110")
+	NewSession(Config{Replay: bytes.NewReader(nil), Status: server})
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		// udids are the devices listed by /, or the session returned for a single udid
+		udids []string
+	}{
+		{name: "all", path: "/", status: http.StatusOK, udids: []string{"00008030", "00008101", ReplayUdid}},
+		{name: "replay", path: "/" + ReplayUdid, status: http.StatusOK, udids: []string{ReplayUdid}},
+		{name: "device without a session", path: "/00008030", status: http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, test.path, nil))
+			if recorder.Code != test.status {
+				t.Fatalf("got status %d, want %d", recorder.Code, test.status)
+			}
+			if test.status != http.StatusOK {
+				return
+			}
+			var udids []string
+			if test.path == "/" {
+				var list struct {
+					Devices  []map[string]interface{} `json:"devices"`
+					Sessions []SessionStatus          `json:"sessions"`
+				}
+				if err := json.Unmarshal(recorder.Body.Bytes(), &list); err != nil {
+					t.Fatal(err)
+				}
+				for _, device := range list.Devices {
+					udids = append(udids, device["udid"].(string))
+				}
+				for _, session := range list.Sessions {
+					udids = append(udids, session.Udid)
+				}
+			} else {
+				var status SessionStatus
+				if err := json.Unmarshal(recorder.Body.Bytes(), &status); err != nil {
+					t.Fatal(err)
+				}
+				udids = append(udids, status.Udid)
+			}
+			if len(udids) != len(test.udids) {
+				t.Fatalf("got %v, want %v", udids, test.udids)
+			}
+			for i := range udids {
+				if udids[i] != test.udids[i] {
+					t.Errorf("got %v, want %v", udids, test.udids)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestSessionStatusCanBeNil(t *testing.T) {
+	var status *sessionStatus
+	status.setDevice(IosDevice{SerialNumber: "00008030"})
+	if _, ok := status.foundDevice(); ok {
+		t.Error("nil status found a device")
+	}
+	if got := status.snapshot("00008030"); got.Udid != "00008030" {
+		t.Errorf("got udid %q", got.Udid)
+	}
+}
@@ -0,0 +1,243 @@
+package mirror
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SupervisorEventType names a transition reported by the Supervisor.
+type SupervisorEventType string
+
+const (
+	// DeviceAttached is emitted when a device shows up on the bus.
+	DeviceAttached SupervisorEventType = "device_attached"
+	// DeviceDetached is emitted when a device was missing for SupervisorConfig.DetachPolls polls.
+	DeviceDetached SupervisorEventType = "device_detached"
+	// SessionStarted is emitted once the QT config of a device is active and it is streaming.
+	SessionStarted SupervisorEventType = "session_started"
+	// SessionFailed is emitted when a session could not be started, it is retried with a growing backoff
+	// as long as the device stays attached.
+	SessionFailed SupervisorEventType = "session_failed"
+	// SessionStopped is emitted after a session released its device.
+	SessionStopped SupervisorEventType = "session_stopped"
+)
+
+// SupervisorEvent describes a single device or session transition.
+type SupervisorEvent struct {
+	Type SupervisorEventType
+	Udid string
+	// Session is set for session events.
+	Session *Session
+	// Err is set for SessionFailed events.
+	Err  error
+	Time time.Time
+}
+
+// SupervisorConfig contains the settings of a Supervisor.
+type SupervisorConfig struct {
+	// PollInterval is the time between two device lookups, defaults to one second.
+	PollInterval time.Duration
+	// DetachPolls is the number of consecutive polls a device has to be missing before it is
+	// considered detached. Enabling the QT config makes devices reconnect, so this defaults to 3.
+	DetachPolls int
+	// SessionConfig returns the session config for an attached device. Devices it returns false for are ignored.
+	// The sinks and video sinks of a session that failed to start are closed again.
+	SessionConfig func(device IosDevice) (Config, bool)
+	// Status lists every attached device in the status api, including the ignored ones. nil leaves them out.
+	Status *StatusServer
+}
+
+// Supervisor polls the USB bus and starts a Session for every device that gets attached
+// and stops it again once the device is detached.
+type Supervisor struct {
+	config  SupervisorConfig
+	events  chan SupervisorEvent
+	ended   chan endedSession
+	devices map[string]*supervisedDevice
+	wg      sync.WaitGroup
+}
+
+// maxRetryBackoff limits the time between two attempts to start a session for a device that stays attached.
+const maxRetryBackoff = time.Minute
+
+// supervisedDevice is tracked from its attach until its detach, whatever happens to its sessions. A detached
+// device is kept until its session stopped, so that it never runs two sessions when it is attached again quickly.
+type supervisedDevice struct {
+	// session is nil while no session runs for the device
+	session *Session
+	missing int
+	// detached is set while the session of a detached device is still stopping
+	detached bool
+	// ignored devices got no config from SupervisorConfig.SessionConfig
+	ignored bool
+	// failures counts the sessions that failed to start in a row, retryAt is when the next one may be started
+	failures int
+	retryAt  time.Time
+}
+
+type endedSession struct {
+	session *Session
+	failed  bool
+}
+
+// NewSupervisor creates a Supervisor, call Run to start watching for devices.
+func NewSupervisor(config SupervisorConfig) *Supervisor {
+	if config.PollInterval <= 0 {
+		config.PollInterval = time.Second
+	}
+	if config.DetachPolls <= 0 {
+		config.DetachPolls = 3
+	}
+	if config.SessionConfig == nil {
+		config.SessionConfig = func(device IosDevice) (Config, bool) {
+			return Config{Udid: device.SerialNumber}, true
+		}
+	}
+	return &Supervisor{
+		config:  config,
+		events:  make(chan SupervisorEvent, 16),
+		ended:   make(chan endedSession),
+		devices: map[string]*supervisedDevice{},
+	}
+}
+
+// Events delivers all transitions and is closed when Run returned. It has to be drained.
+func (s *Supervisor) Events() <-chan SupervisorEvent {
+	return s.events
+}
+
+// Run watches for devices until ctx is cancelled, then stops all sessions and returns.
+func (s *Supervisor) Run(ctx context.Context) {
+	defer close(s.events)
+	ticker := time.NewTicker(s.config.PollInterval)
+	defer ticker.Stop()
+
+	s.poll(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			// sessions stop themselves as they were started with ctx
+			s.wg.Wait()
+			return
+		case ended := <-s.ended:
+			udid := ended.session.config.Udid
+			if device, ok := s.devices[udid]; ok && device.session == ended.session {
+				// the device gets a new session on a later poll if it is still there
+				device.session = nil
+				if device.detached {
+					delete(s.devices, udid)
+				} else if ended.failed {
+					device.failures++
+					device.retryAt = time.Now().Add(s.retryBackoff(device.failures))
+				} else {
+					device.failures = 0
+					device.retryAt = time.Time{}
+				}
+			}
+		case <-ticker.C:
+			s.poll(ctx)
+		}
+	}
+}
+
+func (s *Supervisor) poll(ctx context.Context) {
+	deviceList, err := FindIosDevices()
+	if err != nil {
+		log.Warnf("Failed polling iOS devices: %s", err)
+		return
+	}
+
+	present := map[string]bool{}
+	for _, device := range deviceList {
+		udid := device.SerialNumber
+		present[udid] = true
+		known, ok := s.devices[udid]
+		if !ok || known.detached {
+			s.emit(SupervisorEvent{Type: DeviceAttached, Udid: udid})
+			s.config.Status.attach(device)
+			attached := &supervisedDevice{}
+			if ok {
+				// attached again while the old session is stopping, the new one starts once that ended
+				attached.session = known.session
+			}
+			known = attached
+			s.devices[udid] = known
+		}
+		known.missing = 0
+		if known.session == nil && !known.ignored && !time.Now().Before(known.retryAt) {
+			s.start(ctx, known, device)
+		}
+	}
+
+	for udid, known := range s.devices {
+		if present[udid] || known.detached {
+			continue
+		}
+		known.missing++
+		if known.missing < s.config.DetachPolls {
+			continue
+		}
+		s.emit(SupervisorEvent{Type: DeviceDetached, Udid: udid})
+		s.config.Status.detach(udid)
+		if known.session == nil {
+			delete(s.devices, udid)
+			continue
+		}
+		// the entry is removed once the session ended
+		known.detached = true
+		go known.session.Stop()
+	}
+}
+
+func (s *Supervisor) start(ctx context.Context, known *supervisedDevice, device IosDevice) {
+	config, ok := s.config.SessionConfig(device)
+	if !ok {
+		log.Debugf("Ignoring device '%s'", device.SerialNumber)
+		known.ignored = true
+		return
+	}
+	config.Udid = device.SerialNumber
+	known.session = NewSession(config)
+	s.wg.Add(1)
+	go s.supervise(ctx, known.session)
+}
+
+// retryBackoff is the time to wait after the given number of failed starts, it doubles with every failure.
+func (s *Supervisor) retryBackoff(failures int) time.Duration {
+	backoff := s.config.PollInterval
+	for i := 1; i < failures && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxRetryBackoff {
+		backoff = maxRetryBackoff
+	}
+	return backoff
+}
+
+func (s *Supervisor) supervise(ctx context.Context, session *Session) {
+	defer s.wg.Done()
+	udid := session.config.Udid
+
+	err := session.Start(ctx)
+	if err != nil {
+		session.Stop()
+		s.emit(SupervisorEvent{Type: SessionFailed, Udid: udid, Session: session, Err: err})
+	} else {
+		s.emit(SupervisorEvent{Type: SessionStarted, Udid: udid, Session: session})
+		<-session.Done()
+		s.emit(SupervisorEvent{Type: SessionStopped, Udid: udid, Session: session})
+	}
+
+	select {
+	case s.ended <- endedSession{session: session, failed: err != nil}:
+	case <-ctx.Done():
+	}
+}
+
+func (s *Supervisor) emit(event SupervisorEvent) {
+	event.Time = time.Now()
+	s.events <- event
+}
@@ -0,0 +1,150 @@
+package mirror
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"math"
+	"time"
+)
+
+const (
+	// TileMessageKeyframe marks a message with a single tile covering the whole frame.
+	TileMessageKeyframe = 'K'
+	// TileMessageDelta marks a message with the changed tiles only.
+	TileMessageDelta = 'D'
+)
+
+// TileConfig contains the settings of delta frames.
+//
+// Frames are split into square tiles and only the tiles that changed since the previous message are
+// encoded. A message starts with the type byte TileMessageKeyframe or TileMessageDelta, followed by the
+// big endian uint16 frame width, height and tile count. Each tile consists of its uint16 x, y, width
+// and height, the uint32 length of the encoded image and the image itself.
+type TileConfig struct {
+	// TileSize is the width and height of a tile in pixels, defaults to 64.
+	TileSize int
+	// Threshold is the FastCompare score a tile has to exceed to be sent, 0 sends every change.
+	Threshold int64
+	// KeyframeInterval is the time after which the whole frame is sent again, defaults to ten seconds.
+	// A static screen gets its keyframe as well, the latest frame is resent then.
+	KeyframeInterval time.Duration
+}
+
+// tileEncoder turns frames into keyframe and delta messages.
+type tileEncoder struct {
+	config  TileConfig
+	encoder ImageEncoder
+	// ref is the picture the consumer holds, only the tiles that were sent are copied into it so that
+	// small changes add up until they exceed the threshold
+	ref *image.RGBA
+	// last is the latest frame, it is sent again as keyframe when the screen stays static
+	last         Frame
+	lastKeyframe time.Time
+}
+
+type tile struct {
+	rect image.Rectangle
+	data []byte
+}
+
+func newTileEncoder(config TileConfig, encoder ImageEncoder) *tileEncoder {
+	if config.TileSize <= 0 {
+		config.TileSize = 64
+	}
+	if config.KeyframeInterval <= 0 {
+		config.KeyframeInterval = 10 * time.Second
+	}
+	return &tileEncoder{config: config, encoder: encoder}
+}
+
+// encode returns the message for the frame, or nil if no tile changed enough. Resent frames are keyframes,
+// so that consumers connecting to a static screen get the whole frame.
+func (t *tileEncoder) encode(frame Frame) ([]byte, error) {
+	t.last = frame
+	img := frame.Image
+	bounds := img.Bounds()
+	if t.ref == nil || t.ref.Bounds() != bounds || frame.KeepAlive || frame.Time.Sub(t.lastKeyframe) >= t.config.KeyframeInterval {
+		return t.keyframe(frame.Time)
+	}
+
+	var tiles []tile
+	size := t.config.TileSize
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += size {
+		for x := bounds.Min.X; x < bounds.Max.X; x += size {
+			rect := image.Rect(x, y, x+size, y+size).Intersect(bounds)
+			if tileScore(img, t.ref, rect) <= t.config.Threshold {
+				continue
+			}
+			data, err := t.encoder.Encode(img.SubImage(rect).(*image.RGBA))
+			if err != nil {
+				return nil, err
+			}
+			copyRect(t.ref, img, rect)
+			tiles = append(tiles, tile{rect: rect, data: data})
+		}
+	}
+	if len(tiles) == 0 {
+		return nil, nil
+	}
+	return tileMessage(TileMessageDelta, bounds, tiles), nil
+}
+
+// keyframe returns the latest frame as a whole and makes it the reference.
+func (t *tileEncoder) keyframe(now time.Time) ([]byte, error) {
+	img := t.last.Image
+	bounds := img.Bounds()
+	data, err := t.encoder.Encode(img)
+	if err != nil {
+		return nil, err
+	}
+	if t.ref == nil || t.ref.Bounds() != bounds {
+		t.ref = image.NewRGBA(bounds)
+	}
+	copyRect(t.ref, img, bounds)
+	t.lastKeyframe = now
+	return tileMessage(TileMessageKeyframe, bounds, []tile{{rect: bounds, data: data}}), nil
+}
+
+// nextKeyframe returns when the next keyframe is due, the zero time before the first frame.
+func (t *tileEncoder) nextKeyframe() time.Time {
+	if t.last.Image == nil {
+		return time.Time{}
+	}
+	return t.lastKeyframe.Add(t.config.KeyframeInterval)
+}
+
+// copyRect copies the pixels of rect from src to the equally sized dst.
+func copyRect(dst, src *image.RGBA, rect image.Rectangle) {
+	rowSize := rect.Dx() * 4
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		copy(dst.Pix[dst.PixOffset(rect.Min.X, y):][:rowSize], src.Pix[src.PixOffset(rect.Min.X, y):][:rowSize])
+	}
+}
+
+// tileScore is the FastCompare score of one tile of two equally sized images.
+func tileScore(img1, img2 *image.RGBA, rect image.Rectangle) int64 {
+	accumError := uint64(0)
+	rowSize := rect.Dx() * 4
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		row1 := img1.Pix[img1.PixOffset(rect.Min.X, y):][:rowSize]
+		row2 := img2.Pix[img2.PixOffset(rect.Min.X, y):][:rowSize]
+		for i := range row1 {
+			accumError += sqDiffUInt8(row1[i], row2[i])
+		}
+	}
+	return int64(math.Sqrt(float64(accumError)))
+}
+
+func tileMessage(messageType byte, bounds image.Rectangle, tiles []tile) []byte {
+	message := new(bytes.Buffer)
+	message.WriteByte(messageType)
+	_ = binary.Write(message, binary.BigEndian, []uint16{uint16(bounds.Dx()), uint16(bounds.Dy()), uint16(len(tiles))})
+	for _, tile := range tiles {
+		rect := tile.rect.Sub(bounds.Min)
+		_ = binary.Write(message, binary.BigEndian, []uint16{uint16(rect.Min.X), uint16(rect.Min.Y), uint16(rect.Dx()), uint16(rect.Dy())})
+		_ = binary.Write(message, binary.BigEndian, uint32(len(tile.data)))
+		message.Write(tile.data)
+	}
+	return message.Bytes()
+}
@@ -0,0 +1,162 @@
+package mirror
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/draw"
+	"image/png"
+	"testing"
+	"time"
+
+	"go.nanomsg.org/mangos/v3"
+	"go.nanomsg.org/mangos/v3/protocol/pull"
+)
+
+// applyTiles draws the tiles of a message onto the picture of the consumer, a keyframe replaces it.
+func applyTiles(t *testing.T, picture *image.RGBA, message []byte) (*image.RGBA, byte) {
+	messageType := message[0]
+	width, height := int(binary.BigEndian.Uint16(message[1:])), int(binary.BigEndian.Uint16(message[3:]))
+	count := int(binary.BigEndian.Uint16(message[5:]))
+	if messageType == TileMessageKeyframe {
+		picture = image.NewRGBA(image.Rect(0, 0, width, height))
+	}
+	data := message[7:]
+	for i := 0; i < count; i++ {
+		x, y := int(binary.BigEndian.Uint16(data)), int(binary.BigEndian.Uint16(data[2:]))
+		w, h := int(binary.BigEndian.Uint16(data[4:])), int(binary.BigEndian.Uint16(data[6:]))
+		size := int(binary.BigEndian.Uint32(data[8:]))
+		img, err := png.Decode(bytes.NewReader(data[12 : 12+size]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		draw.Draw(picture, image.Rect(x, y, x+w, y+h), img, img.Bounds().Min, draw.Src)
+		data = data[12+size:]
+	}
+	return picture, messageType
+}
+
+// opaqueImage returns a black picture, png keeps the colors of opaque pixels only.
+func opaqueImage(size int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), image.Black, image.Point{}, draw.Src)
+	return img
+}
+
+func TestTileEncoderSendsAccumulatedChanges(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold int64
+		// the red value of one pixel grows by step every frame up to max
+		step   uint8
+		max    uint8
+		deltas int
+	}{
+		{name: "no change", threshold: 10, step: 0, max: 0, deltas: 0},
+		{name: "every change", threshold: 0, step: 5, max: 95, deltas: 19},
+		{name: "changes above the threshold", threshold: 10, step: 20, max: 100, deltas: 5},
+		{name: "small changes add up", threshold: 10, step: 5, max: 95, deltas: 6},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoder := newTileEncoder(TileConfig{TileSize: 16, Threshold: test.threshold}, ImageEncoder{Format: ImageFormatPng})
+			start := time.Now()
+			var picture *image.RGBA
+			deltas := 0
+			for i := 0; i <= 20; i++ {
+				img := opaqueImage(40)
+				value := int(test.step) * i
+				if value > int(test.max) {
+					value = int(test.max)
+				}
+				img.Pix[img.PixOffset(20, 20)] = uint8(value)
+				message, err := encoder.encode(Frame{Image: img, Time: start.Add(time.Duration(i) * time.Millisecond)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if message != nil {
+					var messageType byte
+					picture, messageType = applyTiles(t, picture, message)
+					if messageType == TileMessageDelta {
+						deltas++
+					}
+				}
+				if score, _ := FastCompare(picture, img); score > test.threshold {
+					t.Fatalf("frame %d: the consumer is off by %d", i, score)
+				}
+			}
+			if deltas != test.deltas {
+				t.Errorf("got %d delta messages, want %d", deltas, test.deltas)
+			}
+		})
+	}
+}
+
+func TestPushSinkSendsKeyframesOfStaticScreen(t *testing.T) {
+	consumer, err := pull.NewSocket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.Close()
+	if err := consumer.SetOption(mangos.OptionRecvDeadline, 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := consumer.Listen("inproc://tiles-keyframes"); err != nil {
+		t.Fatal(err)
+	}
+	config := TileConfig{KeyframeInterval: 50 * time.Millisecond}
+	sink, err := NewPushSink("inproc://tiles-keyframes", PushConfig{Encoder: ImageEncoder{Format: ImageFormatPng}, Tiles: &config, Raw: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	img := opaqueImage(32)
+	img.Pix[0] = 0xff
+	if err := sink.Send(Frame{Image: img, Time: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	// the screen stays static, the first message is sent by Send and the following ones by the timer
+	for i := 0; i < 3; i++ {
+		message, err := consumer.Recv()
+		if err != nil {
+			t.Fatalf("message %d: %s", i, err)
+		}
+		picture, messageType := applyTiles(t, nil, message)
+		if messageType != TileMessageKeyframe {
+			t.Fatalf("message %d has type %c", i, messageType)
+		}
+		if !bytes.Equal(picture.Pix, img.Pix) {
+			t.Fatalf("message %d does not carry the latest frame", i)
+		}
+	}
+}
+
+func TestTileEncoderSendsKeepAliveAsKeyframe(t *testing.T) {
+	encoder := newTileEncoder(TileConfig{}, ImageEncoder{Format: ImageFormatPng})
+	frame := Frame{Image: opaqueImage(32), Time: time.Now()}
+	tests := []struct {
+		name      string
+		keepAlive bool
+		want      byte
+	}{
+		{name: "first frame", want: TileMessageKeyframe},
+		{name: "unchanged frame", want: 0},
+		{name: "resent frame", keepAlive: true, want: TileMessageKeyframe},
+	}
+	for _, test := range tests {
+		frame.Time = frame.Time.Add(time.Second)
+		frame.KeepAlive = test.keepAlive
+		message, err := encoder.encode(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var messageType byte
+		if message != nil {
+			messageType = message[0]
+		}
+		if messageType != test.want {
+			t.Errorf("%s: got message type %q, want %q", test.name, messageType, test.want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package mirror
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/danielpaulus/quicktime_video_hack/screencapture"
+	log "github.com/sirupsen/logrus"
+)
+
+// A usb capture starts with usbCaptureMagic followed by one record per payload read in startReading:
+// the receive time as uint64 little endian unix nanoseconds, the payload length as uint32 little endian
+// and the payload without the 4 bytes length prefix of the usb message.
+const usbCaptureMagic = "QTCAP001"
+
+// capturingReceiver records every payload before handing it to the wrapped receiver.
+type capturingReceiver struct {
+	receiver screencapture.UsbDataReceiver
+	capture  io.Writer
+	failed   bool
+}
+
+func newCapturingReceiver(receiver screencapture.UsbDataReceiver, capture io.Writer) (*capturingReceiver, error) {
+	if _, err := io.WriteString(capture, usbCaptureMagic); err != nil {
+		return nil, err
+	}
+	return &capturingReceiver{receiver: receiver, capture: capture}, nil
+}
+
+func (c *capturingReceiver) ReceiveData(data []byte) {
+	if !c.failed {
+		header := make([]byte, 12)
+		binary.LittleEndian.PutUint64(header, uint64(time.Now().UnixNano()))
+		binary.LittleEndian.PutUint32(header[8:], uint32(len(data)))
+		_, err := c.capture.Write(header)
+		if err == nil {
+			_, err = c.capture.Write(data)
+		}
+		if err != nil {
+			log.Errorf("Failed writing usb capture, stopped capturing: %s", err)
+			c.failed = true
+		}
+	}
+	c.receiver.ReceiveData(data)
+}
+
+func (c *capturingReceiver) CloseSession() {
+	c.receiver.CloseSession()
+}
+
+// discardUsbWriter takes the place of the UsbAdapter when a capture is replayed, answers to the device are dropped.
+type discardUsbWriter struct{}
+
+func (discardUsbWriter) WriteDataToUsb(data []byte) {
+	log.Debugf("Dropping %d bytes for the replayed device", len(data))
+}
+
+// replayUsbCapture feeds all payloads of a usb capture into the receiver. With realtime set it
+// keeps the recorded time between payloads. It returns early without error when ctx is cancelled.
+func replayUsbCapture(ctx context.Context, r io.Reader, receiver screencapture.UsbDataReceiver, realtime bool) error {
+	reader := bufio.NewReader(r)
+	magic := make([]byte, len(usbCaptureMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil {
+		return fmt.Errorf("failed reading usb capture header: %w", err)
+	}
+	if string(magic) != usbCaptureMagic {
+		return errors.New("not a usb capture, header magic does not match")
+	}
+
+	var firstRecorded time.Time
+	start := time.Now()
+	header := make([]byte, 12)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("failed reading usb capture record: %w", err)
+		}
+		recorded := time.Unix(0, int64(binary.LittleEndian.Uint64(header)))
+		data := make([]byte, binary.LittleEndian.Uint32(header[8:]))
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return fmt.Errorf("failed reading usb capture payload: %w", err)
+		}
+
+		if realtime {
+			if firstRecorded.IsZero() {
+				firstRecorded = recorded
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(time.Until(start.Add(recorded.Sub(firstRecorded)))):
+			}
+		} else if ctx.Err() != nil {
+			return nil
+		}
+		receiver.ReceiveData(data)
+	}
+}
@@ -0,0 +1,168 @@
+package mirror
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/danielpaulus/quicktime_video_hack/screencapture"
+	"github.com/google/gousb"
+	log "github.com/sirupsen/logrus"
+)
+
+// startReading streams the usb messages of the device into the receiver until ctx is cancelled or reading fails.
+// Whatever was set up is released in order on every return: the usb stream, the interface, the config and
+// finally the QuickTime config of the device is disabled.
+func startReading(ctx context.Context, usa *UsbAdapter, device IosDevice, receiver screencapture.UsbDataReceiver, metrics *deviceMetrics) error {
+	usbCtx, cleanUp := createContext()
+	defer cleanUp()
+
+	usbDevice, err := OpenDevice(usbCtx, device)
+	if err != nil {
+		return err
+	}
+	defer usbDevice.Close()
+	if !device.IsActivated() {
+		return errors.New("device not activated for screen mirroring")
+	}
+	defer sendQTDisable(usbDevice)
+	if ctx.Err() != nil {
+		// the session was stopped while the device was activated
+		return nil
+	}
+	confignum, _ := usbDevice.ActiveConfigNum()
+
+	log.Debugf("Config is active: %d, QT config is: %d", confignum, device.QTConfigIndex)
+
+	config, err := usbDevice.Config(device.QTConfigIndex)
+	if err != nil {
+		return errors.New("Could not retrieve config")
+	}
+	defer func() {
+		log.Info("Closing config")
+		_ = config.Close()
+	}()
+
+	log.Debugf("QT Config is active: %s", config.String())
+
+	val, err := usbDevice.Control(0x02, 0x01, 0, 0x86, make([]byte, 0))
+	if err != nil {
+		log.Debug("failed control", err)
+	}
+	log.Debugf("Clear Feature RC: %d", val)
+
+	val, err = usbDevice.Control(0x02, 0x01, 0, 0x05, make([]byte, 0))
+	if err != nil {
+		log.Debug("failed control", err)
+	}
+	log.Debugf("Clear Feature RC: %d", val)
+
+	iface, err := grabQuickTimeInterface(config)
+	if err != nil {
+		log.Debug("could not get Quicktime Interface")
+		return err
+	}
+	defer func() {
+		log.Info("Closing usb interface")
+		iface.Close()
+	}()
+	log.Debugf("Got QT iface:%s", iface.String())
+
+	inboundBulkEndpointIndex, err := grabInBulk(iface.Setting)
+	if err != nil {
+		return err
+	}
+	inEndpoint, err := iface.InEndpoint(inboundBulkEndpointIndex)
+	if err != nil {
+		log.Error("couldnt get InEndpoint")
+		return err
+	}
+	log.Debugf("Inbound Bulk: %s", inEndpoint.String())
+
+	outboundBulkEndpointIndex, err := grabOutBulk(iface.Setting)
+	if err != nil {
+		return err
+	}
+	outEndpoint, err := iface.OutEndpoint(outboundBulkEndpointIndex)
+	if err != nil {
+		log.Error("couldnt get OutEndpoint")
+		return err
+	}
+	log.Debugf("Outbound Bulk: %s", outEndpoint.String())
+
+	usa.outEndpoint = outEndpoint
+
+	stream, err := inEndpoint.NewStream(4096, 5)
+	if err != nil {
+		log.Error("couldnt create stream")
+		return err
+	}
+	log.Debug("Endpoint claimed")
+	log.Infof("Device '%s' USB connection ready, waiting for ping..", device.SerialNumber)
+
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(readErr)
+		for {
+			buffer := make([]byte, 4)
+
+			n, err := io.ReadFull(stream, buffer)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Errorf("Failed reading 4bytes length with err:%s only received: %d", err, n)
+					readErr <- err
+				}
+				return
+			}
+
+			//the 4 bytes header are included in the length, so we need to subtract them
+			//here to know how long the payload will be
+			length := binary.LittleEndian.Uint32(buffer) - 4
+			dataBuffer := make([]byte, length)
+
+			n, err = io.ReadFull(stream, dataBuffer)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Errorf("Failed reading payload with err:%s only received: %d/%d bytes", err, n, length)
+					readErr <- err
+				}
+				return
+			}
+			metrics.add(counterUsbMessages, 1)
+			metrics.add(counterUsbBytes, uint64(length)+4)
+			receiver.ReceiveData(dataBuffer)
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		// the device answers the close messages on the stream, so it is still being read
+		receiver.CloseSession()
+	case err = <-readErr:
+	}
+	log.Info("Closing usb stream")
+	if closeErr := stream.Close(); closeErr != nil {
+		log.Error("Error closing stream", closeErr)
+	}
+	// nothing may reach the receiver once the stream is gone
+	<-readErr
+	if err != nil {
+		return fmt.Errorf("usb stream of device '%s' failed: %w", device.SerialNumber, err)
+	}
+	return nil
+}
+
+// Stuff below more or less copied from quicktime_video_hack/screencapture/usbadapter.go and other files in that directory
+// All of these stuff has to be copied in order to alter startReading due to non-exposed functions and variables
+type UsbAdapter struct {
+	outEndpoint *gousb.OutEndpoint
+}
+
+func (usa UsbAdapter) WriteDataToUsb(bytes []byte) {
+	_, err := usa.outEndpoint.Write(bytes)
+	if err != nil {
+		log.Error("failed sending to usb", err)
+	}
+}
@@ -0,0 +1,98 @@
+package mirror
+
+import (
+	"time"
+
+	cm "github.com/danielpaulus/quicktime_video_hack/screencapture/coremedia"
+	log "github.com/sirupsen/logrus"
+)
+
+// AccessUnit holds the h264 nalus of one picture as the device sent them, without start codes or length prefixes.
+// The slices are shared between all sinks and must not be modified.
+type AccessUnit struct {
+	Udid  string
+	Nalus [][]byte
+	// SPS and PPS are the parameter sets of the latest format description.
+	SPS []byte
+	PPS []byte
+	// Width and Height are the video dimensions of the latest format description.
+	Width  int
+	Height int
+	// Keyframe is set if the picture contains an IDR slice.
+	Keyframe bool
+	// PresentationTime is the presentation timestamp of the CMSampleBuffer.
+	PresentationTime time.Duration
+	// Time is the wall time the picture was received at.
+	Time time.Time
+}
+
+// VideoSink receives the h264 stream of a session without decoding it. SendVideo is called from the
+// goroutine reading the device and must not block, Close is called once after the stream ended.
+type VideoSink interface {
+	SendVideo(unit AccessUnit) error
+	Close() error
+}
+
+// videoDispatcher turns the CMSampleBuffers of IOSImageReceiver into access units for the video sinks.
+type videoDispatcher struct {
+	udid   string
+	sinks  []VideoSink
+	sps    []byte
+	pps    []byte
+	width  int
+	height int
+	onErr  func(err error)
+}
+
+func newVideoDispatcher(udid string, sinks []VideoSink, onErr func(err error)) *videoDispatcher {
+	return &videoDispatcher{udid: udid, sinks: sinks, onErr: onErr}
+}
+
+func (v *videoDispatcher) setFormat(format cm.FormatDescriptor) {
+	width, height := int(format.VideoDimensionWidth), int(format.VideoDimensionHeight)
+	if v.sps != nil && (width != v.width || height != v.height) {
+		log.WithFields(log.Fields{
+			"type":   "resolution_changed",
+			"udid":   v.udid,
+			"width":  width,
+			"height": height,
+		}).Info("Video resolution changed")
+	}
+	v.sps = format.SPS
+	v.pps = format.PPS
+	v.width = width
+	v.height = height
+}
+
+func (v *videoDispatcher) send(buf cm.CMSampleBuffer) {
+	if v.sps == nil {
+		// nothing can be decoded without the parameter sets
+		return
+	}
+	unit := AccessUnit{
+		Udid:             v.udid,
+		SPS:              v.sps,
+		PPS:              v.pps,
+		Width:            v.width,
+		Height:           v.height,
+		PresentationTime: time.Duration(toTimescale(presentationTime(buf), uint64(time.Second))),
+		Time:             time.Now(),
+	}
+	forEachNalu(buf.SampleData, func(nalu []byte) {
+		if len(nalu) == 0 {
+			return
+		}
+		unit.Nalus = append(unit.Nalus, nalu)
+		if nalu[0]&0x1f == naluTypeIdrSlice {
+			unit.Keyframe = true
+		}
+	})
+	if len(unit.Nalus) == 0 {
+		return
+	}
+	for _, sink := range v.sinks {
+		if err := sink.SendVideo(unit); err != nil {
+			v.onErr(err)
+		}
+	}
+}
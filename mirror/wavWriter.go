@@ -0,0 +1,132 @@
+package mirror
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	cm "github.com/danielpaulus/quicktime_video_hack/screencapture/coremedia"
+)
+
+const (
+	wavHeaderLength = 44
+	// audio format flags of the AudioStreamBasicDescription, see CoreAudioTypes.h
+	audioFormatFlagIsFloat     = 1 << 0
+	audioFormatFlagIsBigEndian = 1 << 1
+	// wav audio formats
+	wavFormatPcm   = 1
+	wavFormatFloat = 3
+)
+
+// wavWriter writes lpcm audio into a wav file. The header is written with a zero length up front
+// and rewritten with the final length by finalize, which is why it needs a io.WriteSeeker.
+type wavWriter struct {
+	mu         sync.Mutex
+	w          io.WriteSeeker
+	format     cm.AudioStreamBasicDescription
+	started    bool
+	finalized  bool
+	dataLength uint32
+}
+
+func newWavWriter(w io.WriteSeeker) *wavWriter {
+	return &wavWriter{w: w, format: cm.DefaultAudioStreamBasicDescription()}
+}
+
+// setFormat takes the format of the audio stream from its format description. Changing the
+// format once samples were written is not supported by wav and is rejected.
+func (ww *wavWriter) setFormat(format cm.AudioStreamBasicDescription) error {
+	ww.mu.Lock()
+	defer ww.mu.Unlock()
+	if format.FormatID != cm.AudioFormatIDLpcm {
+		return fmt.Errorf("unsupported audio format %x, only lpcm can be written to wav", format.FormatID)
+	}
+	if ww.started {
+		if format != ww.format {
+			return fmt.Errorf("audio format changed from %s to %s", ww.format, format)
+		}
+		return nil
+	}
+	ww.format = format
+	return nil
+}
+
+func (ww *wavWriter) write(samples []byte) error {
+	ww.mu.Lock()
+	defer ww.mu.Unlock()
+	if ww.finalized {
+		return errors.New("wav file already finalized")
+	}
+	if !ww.started {
+		if _, err := ww.w.Write(ww.header()); err != nil {
+			return err
+		}
+		ww.started = true
+	}
+	if ww.format.FormatFlags&audioFormatFlagIsBigEndian != 0 {
+		samples = swapSampleBytes(samples, int(ww.format.BitsPerChannel/8))
+	}
+	n, err := ww.w.Write(samples)
+	ww.dataLength += uint32(n)
+	return err
+}
+
+// finalize rewrites the header with the length of all written samples.
+func (ww *wavWriter) finalize() error {
+	ww.mu.Lock()
+	defer ww.mu.Unlock()
+	if ww.finalized || !ww.started {
+		ww.finalized = true
+		return nil
+	}
+	ww.finalized = true
+	if _, err := ww.w.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := ww.w.Write(ww.header()); err != nil {
+		return err
+	}
+	_, err := ww.w.Seek(0, io.SeekEnd)
+	return err
+}
+
+// header returns the canonical 44 bytes wav header, see http://soundfile.sapp.org/doc/WaveFormat/
+func (ww *wavWriter) header() []byte {
+	audioFormat := uint16(wavFormatPcm)
+	if ww.format.FormatFlags&audioFormatFlagIsFloat != 0 {
+		audioFormat = wavFormatFloat
+	}
+	sampleRate := uint32(ww.format.SampleRate)
+
+	header := make([]byte, wavHeaderLength)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], 36+ww.dataLength)
+	copy(header[8:], "WAVE")
+	copy(header[12:], "fmt ")
+	binary.LittleEndian.PutUint32(header[16:], 16)
+	binary.LittleEndian.PutUint16(header[20:], audioFormat)
+	binary.LittleEndian.PutUint16(header[22:], uint16(ww.format.ChannelsPerFrame))
+	binary.LittleEndian.PutUint32(header[24:], sampleRate)
+	binary.LittleEndian.PutUint32(header[28:], sampleRate*ww.format.BytesPerFrame)
+	binary.LittleEndian.PutUint16(header[32:], uint16(ww.format.BytesPerFrame))
+	binary.LittleEndian.PutUint16(header[34:], uint16(ww.format.BitsPerChannel))
+	copy(header[36:], "data")
+	binary.LittleEndian.PutUint32(header[40:], ww.dataLength)
+	return header
+}
+
+// swapSampleBytes converts big endian samples of the given byte width into little endian ones as wav expects them.
+func swapSampleBytes(samples []byte, width int) []byte {
+	if width < 2 {
+		return samples
+	}
+	swapped := make([]byte, len(samples))
+	for i := 0; i+width <= len(samples); i += width {
+		for j := 0; j < width; j++ {
+			swapped[i+j] = samples[i+width-1-j]
+		}
+	}
+	return swapped
+}
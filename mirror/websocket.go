@@ -0,0 +1,119 @@
+package mirror
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+const wsWriteTimeout = 5 * time.Second
+
+// WebSocketServer pushes every frame as a binary message to the websockets connected on /stream/<udid>
+// and serves a canvas based viewer on /. A message is an envelope as described by FrameHeader.
+type WebSocketServer struct {
+	streams  *broadcaster
+	upgrader websocket.Upgrader
+}
+
+// NewWebSocketServer creates a WebSocketServer, register it with a http.Server and add Sink to the session configs.
+func NewWebSocketServer(config StreamConfig) *WebSocketServer {
+	return &WebSocketServer{streams: newBroadcaster(config.SendLatestOnConnect)}
+}
+
+// Sink returns a FrameSink that publishes the frames of one session. Closing it ends the streams of its device.
+// The viewer only shows jpeg and png images.
+func (s *WebSocketServer) Sink(encoder ImageEncoder) FrameSink {
+	return &webSocketSink{streams: s.streams, encoder: encoder}
+}
+
+func (s *WebSocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if udid := strings.TrimPrefix(r.URL.Path, "/stream/"); udid != r.URL.Path {
+		s.serveStream(w, r, udid)
+		return
+	}
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := webTemplates.ExecuteTemplate(w, "viewer.html", s.streams.udids()); err != nil {
+		log.Errorf("Failed rendering viewer page: %s", err)
+	}
+}
+
+func (s *WebSocketServer) serveStream(w http.ResponseWriter, r *http.Request, udid string) {
+	sub := s.streams.subscribe(udid)
+	if sub == nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer sub.close()
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Debugf("Websocket upgrade for '%s' failed: %s", udid, err)
+		return
+	}
+	defer conn.Close()
+
+	// the viewer never sends anything, reading is only needed to notice when it goes away
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-gone:
+			return
+		case data, ok := <-sub.messages:
+			if !ok {
+				_ = conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, "stream ended"), time.Now().Add(wsWriteTimeout))
+				return
+			}
+			_ = conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+				log.Debugf("Websocket client of '%s' gone: %s", udid, err)
+				return
+			}
+		}
+	}
+}
+
+type webSocketSink struct {
+	streams  *broadcaster
+	encoder  ImageEncoder
+	udid     string
+	sequence uint64
+}
+
+func (ws *webSocketSink) Send(frame Frame) error {
+	data, err := frame.encode(ws.encoder)
+	if err != nil {
+		return err
+	}
+	ws.udid = frame.Udid
+	ws.sequence++
+	message, err := envelope(frameHeader(frame, ws.sequence, string(ws.encoder.format()), ws.encoder.ContentType()), data)
+	if err != nil {
+		return err
+	}
+	ws.streams.publish(frame.Udid, message)
+	return nil
+}
+
+func (ws *webSocketSink) Close() error {
+	if ws.udid != "" {
+		ws.streams.remove(ws.udid)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/luke-cha/ios-screen-mirror/mirror"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	formatJpeg = "jpeg"
+	formatH264 = "h264"
+)
+
+// pullOptions contains the settings shared by all pulled devices.
+type pullOptions struct {
+	// format is what gets pushed to the push spec, formatJpeg or formatH264
+	format string
+	// push contains the encoding, delta frames and envelope settings of the push sockets
+	push mirror.PushConfig
+	// viewerEncoder encodes the frames of the http viewers, browsers need jpeg or png
+	viewerEncoder   mirror.ImageEncoder
+	screenRatio     float64
+	scale           mirror.ScaleConfig
+	changeThreshold int64
+	keepAlive       time.Duration
+	mjpeg           *mirror.MjpegServer
+	webSocket       *mirror.WebSocketServer
+	rtsp            *mirror.RtspServer
+	metrics         *mirror.Metrics
+	status          *mirror.StatusServer
+	hls             mirror.HlsConfig
+	// devices holds the settings of the config file per udid
+	devices map[string]deviceSettings
+}
+
+// sessionConfig returns the config shared by all sessions, without any outputs.
+func (o pullOptions) sessionConfig() mirror.Config {
+	config := mirror.Config{
+		ScreenRatio:     o.screenRatio,
+		Scale:           o.scale,
+		ChangeThreshold: &o.changeThreshold,
+		KeepAlive:       o.keepAlive,
+		Metrics:         o.metrics,
+		Status:          o.status,
+	}
+	if o.push.Tiles != nil && o.mjpeg == nil && o.webSocket == nil {
+		// delta frames compare the tiles themselves, viewers sharing the frames keep the threshold
+		every := int64(-1)
+		config.ChangeThreshold = &every
+	}
+	return config
+}
+
+// forDevice returns the options and outputs of the device with its settings of the config file applied.
+func (o pullOptions) forDevice(target pullTarget) (pullOptions, pullTarget) {
+	if settings, ok := o.devices[target.udid]; ok {
+		settings.apply(&o, &target)
+	}
+	return o, target
+}
+
+// sinks creates the frame sinks of one device, an empty push spec disables the push socket.
+// No frame sinks means nothing has to be decoded.
+func (o pullOptions) sinks(pushSpec string) ([]mirror.FrameSink, error) {
+	var sinks []mirror.FrameSink
+	if pushSpec != "" && o.format == formatJpeg {
+		sink, err := mirror.NewPushSink(pushSpec, o.push)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"type": "err_socket_connect",
+				"spec": pushSpec,
+				"err":  err,
+			}).Error("Socket connect error")
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if o.mjpeg != nil {
+		sinks = append(sinks, o.mjpeg.Sink(o.viewerEncoder))
+	}
+	if o.webSocket != nil {
+		sinks = append(sinks, o.webSocket.Sink(o.viewerEncoder))
+	}
+	return sinks, nil
+}
+
+// videoSinks creates the sinks of one device that take the h264 stream without decoding it,
+// an empty hls directory disables the hls output.
+func (o pullOptions) videoSinks(pushSpec string, hlsDir string) ([]mirror.VideoSink, error) {
+	var sinks []mirror.VideoSink
+	if pushSpec != "" && o.format == formatH264 {
+		sink, err := mirror.NewH264PushSink(pushSpec, o.push)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"type": "err_socket_connect",
+				"spec": pushSpec,
+				"err":  err,
+			}).Error("Socket connect error")
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if hlsDir != "" {
+		sink, err := mirror.NewHlsSink(hlsDir, o.hls)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"type": "err_hls_dir",
+				"dir":  hlsDir,
+				"err":  err,
+			}).Error("HLS directory error")
+			closeSinks(nil, sinks)
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if o.rtsp != nil {
+		sinks = append(sinks, o.rtsp.Sink())
+	}
+	return sinks, nil
+}
+
+// closeSinks closes sinks that were created for a session that is not going to run.
+func closeSinks(sinks []mirror.FrameSink, videoSinks []mirror.VideoSink) {
+	for _, sink := range sinks {
+		if err := sink.Close(); err != nil {
+			log.Warnf("Failed closing sink: %s", err)
+		}
+	}
+	for _, sink := range videoSinks {
+		if err := sink.Close(); err != nil {
+			log.Warnf("Failed closing video sink: %s", err)
+		}
+	}
+}
+
+func serveHTTP(addr string, handler http.Handler) {
+	go func() {
+		if err := http.ListenAndServe(addr, handler); err != nil {
+			log.WithFields(log.Fields{
+				"type": "err_http_listen",
+				"addr": addr,
+				"err":  err,
+			}).Fatal("HTTP server error")
+		}
+	}()
+}
+
+func serveRtsp(addr string, server *mirror.RtspServer) {
+	go func() {
+		if err := server.ListenAndServe(addr); err != nil {
+			log.WithFields(log.Fields{
+				"type": "err_rtsp_listen",
+				"addr": addr,
+				"err":  err,
+			}).Fatal("RTSP server error")
+		}
+	}()
+}
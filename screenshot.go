@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/luke-cha/ios-screen-mirror/mirror"
+	log "github.com/sirupsen/logrus"
+)
+
+// Exit codes of the -screenshot command, invalid arguments exit with 1 like every other command.
+const (
+	exitNoDevice    = 2
+	exitNoFrame     = 3
+	exitWriteFailed = 4
+)
+
+// screenshotFormat returns the format of the screenshot file, -imageFormat wins over the file extension.
+func screenshotFormat(filename string, imageFormat string, explicit bool) (mirror.ImageFormat, error) {
+	if explicit {
+		return mirror.ParseImageFormat(imageFormat)
+	}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".png":
+		return mirror.ImageFormatPng, nil
+	case ".rgba":
+		return mirror.ImageFormatRgba, nil
+	case ".yuv":
+		return mirror.ImageFormatYuv, nil
+	}
+	return mirror.ImageFormatJpeg, nil
+}
+
+// screenshot writes the first frame decoded after an IDR picture of the device into the file and returns
+// the exit code of the command. The QuickTime config is disabled again before it returns.
+func screenshot(udid string, filename string, encoder mirror.ImageEncoder, options pullOptions, timeout time.Duration) int {
+	config := options.sessionConfig()
+	config.Udid = udid
+	// the very first frame is wanted, whatever it looks like
+	every := int64(-1)
+	config.ChangeThreshold = &every
+	session := mirror.NewSession(config)
+
+	signalCtx, stop := shutdownContext()
+	defer stop()
+	ctx, cancel := context.WithTimeout(signalCtx, timeout)
+	defer cancel()
+
+	if err := startSession(ctx, session); err != nil {
+		printErrJSON(err, "Error activating device")
+		return exitNoDevice
+	}
+
+	var lastErr error
+	errs := session.Errors()
+	var frame mirror.Frame
+	received := false
+	for !received {
+		select {
+		case f, ok := <-session.Frames():
+			if !ok {
+				if errs != nil {
+					for err := range errs {
+						lastErr = err
+					}
+				}
+				if lastErr == nil {
+					lastErr = errors.New("stream ended before the first frame")
+				}
+				printErrJSON(lastErr, "No screenshot taken")
+				session.Stop()
+				return exitNoFrame
+			}
+			frame, received = f, true
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			log.Errorf("Session failure - %s", err)
+			lastErr = err
+		case <-ctx.Done():
+			session.Stop()
+			err := fmt.Errorf("no frame within %s", timeout)
+			if signalCtx.Err() != nil {
+				err = errors.New("stopped by signal before the first frame")
+			}
+			printErrJSON(err, "No screenshot taken")
+			return exitNoFrame
+		}
+	}
+	session.Stop()
+
+	data, err := encoder.Encode(frame.Image)
+	if err != nil {
+		printErrJSON(err, "Error encoding screenshot")
+		return exitWriteFailed
+	}
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		printErrJSON(err, "Error writing screenshot")
+		return exitWriteFailed
+	}
+	printJSON(map[string]interface{}{
+		"screenshot":  filename,
+		"udid":        frame.Udid,
+		"width":       frame.Image.Bounds().Dx(),
+		"height":      frame.Image.Bounds().Dy(),
+		"orientation": frame.Orientation,
+	})
+	return 0
+}